@@ -0,0 +1,75 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+
+	"backend/common/clog"
+	"github.com/zh4af/loggather/protocol"
+)
+
+// Version 客户端版本, 发布时用 -ldflags "-X github.com/zh4af/loggather/client.Version=x.y.z" 覆盖
+var Version = "2.0.0"
+
+// AgentConfig 不配置时自动获取
+type AgentConfig struct {
+	Hostname  string
+	Ip        string
+	Heartbeat int // 心跳间隔(秒), 默认30, 小于0不发送
+}
+
+var gAgent protocol.AgentInfo
+
+// AgentId首次启动时生成, 之后一直沿用, 主机名或IP变化后服务端仍能识别是同一个客户端
+func initAgent(cfg AgentConfig, store CheckpointStore) error {
+	id, err := store.LoadAgentId()
+	if nil != err {
+		return err
+	}
+	if id == "" {
+		if id, err = newAgentId(); nil != err {
+			return err
+		}
+		if err = store.SaveAgentId(id); nil != err {
+			return err
+		}
+		clog.Logger.Info("generate agent id: %s", id)
+	}
+
+	gAgent = protocol.AgentInfo{AgentId: id, Hostname: cfg.Hostname, Ip: cfg.Ip, Version: Version}
+	if gAgent.Hostname == "" {
+		if gAgent.Hostname, err = os.Hostname(); nil != err {
+			return err
+		}
+	}
+	if gAgent.Ip == "" {
+		gAgent.Ip = localIp()
+	}
+	clog.Logger.Info("agent: %+v", gAgent)
+	return nil
+}
+
+func newAgentId() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); nil != err {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// 第一个非回环的IPv4地址
+func localIp() string {
+	addrs, err := net.InterfaceAddrs()
+	if nil != err {
+		clog.Logger.Warning("get interface addrs err: %v", err)
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"backend/common/clog"
+	"backend/common/config"
+)
+
+const (
+	BALANCE_HASH       = "hash"
+	BALANCE_ROUNDROBIN = "roundrobin"
+
+	ETCD_SERVICE_NAME    = "loggather"
+	DEFAULT_ETCD_REFRESH = 60 // 秒
+	DEFAULT_REPORT_PATH  = "/loggather/report"
+)
+
+var errBadBalance = errors.New("unknown balance, should be hash or roundrobin")
+var errNoServers = errors.New("empty report server list")
+
+// serverPool 上报服务端列表, 没有配置时直接使用输入的ReportUrl
+type serverPool struct {
+	balance string
+	next    uint64 // roundrobin的下一个起点
+
+	sync.RWMutex
+	servers []*url.URL
+}
+
+func newServerPool(cfg DeliveryConfig) (*serverPool, error) {
+	p := &serverPool{balance: cfg.Balance}
+	if p.balance == "" {
+		p.balance = BALANCE_HASH
+	}
+	if p.balance != BALANCE_HASH && p.balance != BALANCE_ROUNDROBIN {
+		return nil, errBadBalance
+	}
+	if err := p.setServers(cfg.Servers); nil != err {
+		return nil, err
+	}
+
+	if cfg.EtcdAddr != "" && cfg.EtcdPath != "" {
+		if err := p.loadEtcd(cfg); nil != err {
+			// 启动时etcd不可用, 先用配置中的列表, 之后定时重试
+			clog.Logger.Error("load report servers from etcd err: %v", err)
+		}
+		go p.refreshEtcd(cfg)
+	}
+	return p, nil
+}
+
+// 地址可以不带协议, 如 10.0.0.1:2127
+func (p *serverPool) setServers(servers []string) error {
+	list := make([]*url.URL, 0, len(servers))
+	for _, s := range servers {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "://") {
+			s = "http://" + s
+		}
+		u, err := url.Parse(s)
+		if nil != err {
+			return err
+		}
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+
+	p.Lock()
+	p.servers = list
+	p.Unlock()
+	return nil
+}
+
+// etcd中保存JSON数组, 如 ["10.0.0.1:2127", "10.0.0.2:2127"]
+func (p *serverPool) loadEtcd(cfg DeliveryConfig) error {
+	content, err := config.LoadContentFromEtcd(strings.Split(cfg.EtcdAddr, ","), ETCD_SERVICE_NAME, cfg.EtcdPath)
+	if nil != err {
+		return err
+	}
+	var servers []string
+	if err = json.Unmarshal([]byte(content), &servers); nil != err {
+		return err
+	}
+	if len(servers) == 0 {
+		return errNoServers
+	}
+	return p.setServers(servers)
+}
+
+func (p *serverPool) refreshEtcd(cfg DeliveryConfig) {
+	interval := time.Duration(cfg.EtcdRefresh) * time.Second
+	if interval <= 0 {
+		interval = DEFAULT_ETCD_REFRESH * time.Second
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		if err := p.loadEtcd(cfg); nil != err {
+			clog.Logger.Error("refresh report servers from etcd err: %v", err)
+		}
+	}
+}
+
+// Candidates 按优先顺序返回这次上报可以尝试的地址, 前面的不可用时依次换下一个
+// hash: 同一个文件总是先发往同一台服务端, 服务端上的文件内容保持有序
+// roundrobin: 依次轮换起点
+func (p *serverPool) Candidates(report_url, file_name string) []string {
+	p.RLock()
+	servers := p.servers
+	p.RUnlock()
+	if len(servers) == 0 {
+		return []string{report_url}
+	}
+
+	u, err := url.Parse(report_url)
+	if nil != err || u.Path == "" {
+		u = &url.URL{Path: DEFAULT_REPORT_PATH}
+	}
+
+	order := make([]*url.URL, len(servers))
+	if p.balance == BALANCE_ROUNDROBIN {
+		start := int(atomic.AddUint64(&p.next, 1) % uint64(len(servers)))
+		for i := range servers {
+			order[i] = servers[(start+i)%len(servers)]
+		}
+	} else {
+		// rendezvous hash, 增减服务端时只有少量文件换服务端
+		copy(order, servers)
+		weight := make(map[*url.URL]uint32, len(order))
+		for _, s := range order {
+			weight[s] = crc32.ChecksumIEEE([]byte(s.Host + "/" + file_name))
+		}
+		sort.SliceStable(order, func(i, j int) bool { return weight[order[i]] > weight[order[j]] })
+	}
+
+	urls := make([]string, len(order))
+	for i, s := range order {
+		target := *u
+		target.Scheme = s.Scheme
+		target.Host = s.Host
+		urls[i] = target.String()
+	}
+	return urls
+}
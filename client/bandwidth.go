@@ -0,0 +1,170 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/common/clog"
+	"backend/common/config"
+	"third/go-metrics"
+)
+
+const (
+	BANDWIDTH_CHECK_INTERVAL = time.Second // 检查积压, 切换追赶速度的间隔
+)
+
+var errBadBandwidth = errors.New("bad bandwidth config")
+
+// BandwidthConfig 整个客户端的上报带宽, 所有文件和落盘重发共用, 按压缩后的字节数计算
+// 运行时可以通过etcd或SIGHUP重新读取配置文件修改
+type BandwidthConfig struct {
+	BytesPerSec        int64  // 每秒最多上报多少字节, 0不限制
+	CatchupBytesPerSec int64  // 积压超过CatchupBacklog时使用的速度, 0不切换
+	CatchupBacklog     int64  // 未上报的字节数(未读的文件内容加落盘未重发的数据)超过多少时切换到追赶速度
+	EtcdPath           string // 配置后从etcd读取以上三项(JSON), 使用Delivery的EtcdAddr和EtcdRefresh, 实际key为 /config/loggather/<EtcdPath>
+}
+
+// bandwidthThrottle 客户端启动前就存在, 没有配置时不限制
+type bandwidthThrottle struct {
+	bucket *tokenBucket
+
+	sync.Mutex
+	cfg     BandwidthConfig
+	catchup bool  // 是否处于追赶状态
+	rate    int64 // 当前生效的速度, 0不限制
+
+	rateGauge    metrics.Gauge
+	backlogGauge metrics.Gauge
+}
+
+var gThrottle = &bandwidthThrottle{
+	bucket:       newTokenBucket(0, 0),
+	rateGauge:    metrics.GetOrRegisterGauge("bandwidth.rate", nil),
+	backlogGauge: metrics.GetOrRegisterGauge("bandwidth.backlog", nil),
+}
+
+func checkBandwidth(cfg BandwidthConfig) error {
+	if cfg.BytesPerSec < 0 || cfg.CatchupBytesPerSec < 0 || cfg.CatchupBacklog < 0 {
+		return errBadBandwidth
+	}
+	return nil
+}
+
+// Start 应用配置, 开始按积压切换速度, 配置了etcd时定时刷新
+func (t *bandwidthThrottle) Start(cfg BandwidthConfig, delivery DeliveryConfig) error {
+	if err := checkBandwidth(cfg); nil != err {
+		return err
+	}
+	t.Set(cfg)
+
+	if delivery.EtcdAddr != "" && cfg.EtcdPath != "" {
+		if err := t.loadEtcd(delivery.EtcdAddr, cfg.EtcdPath); nil != err {
+			// 启动时etcd不可用, 先用配置文件中的值, 之后定时重试
+			clog.Logger.Error("load bandwidth from etcd err: %v", err)
+		}
+		go t.refreshEtcd(delivery, cfg.EtcdPath)
+	}
+	go t.monitor()
+	return nil
+}
+
+// Set 修改配置, 立即生效
+func (t *bandwidthThrottle) Set(cfg BandwidthConfig) {
+	t.Lock()
+	defer t.Unlock()
+	if cfg.BytesPerSec != t.cfg.BytesPerSec || cfg.CatchupBytesPerSec != t.cfg.CatchupBytesPerSec ||
+		cfg.CatchupBacklog != t.cfg.CatchupBacklog {
+		clog.Logger.Info("bandwidth: %d bytes/s, catchup: %d bytes/s when backlog > %d bytes",
+			cfg.BytesPerSec, cfg.CatchupBytesPerSec, cfg.CatchupBacklog)
+	}
+	t.cfg = cfg
+	t.apply()
+}
+
+// 按当前配置和追赶状态设置令牌桶, 调用方需持有锁
+func (t *bandwidthThrottle) apply() {
+	rate := t.cfg.BytesPerSec
+	if t.catchup && t.cfg.CatchupBytesPerSec > 0 {
+		rate = t.cfg.CatchupBytesPerSec
+	}
+	if rate != t.rate && rate > 0 {
+		// 最多攒一秒的量, 空闲后不会突发太多
+		t.bucket.SetRate(float64(rate), float64(rate))
+	}
+	t.rate = rate
+	t.rateGauge.Update(rate)
+}
+
+// Wait 发送n字节前调用, 超出速度时阻塞
+func (t *bandwidthThrottle) Wait(n int) {
+	t.Lock()
+	rate := t.rate
+	t.Unlock()
+	if rate > 0 && n > 0 {
+		t.bucket.Wait(float64(n))
+	}
+}
+
+// 积压超过阈值时切换到追赶速度, 低于阈值后恢复
+func (t *bandwidthThrottle) monitor() {
+	tick := time.NewTicker(BANDWIDTH_CHECK_INTERVAL)
+	defer tick.Stop()
+	for range tick.C {
+		backlog := totalBacklog()
+		t.backlogGauge.Update(backlog)
+
+		t.Lock()
+		catchup := t.cfg.CatchupBytesPerSec > 0 && backlog > t.cfg.CatchupBacklog
+		if catchup != t.catchup {
+			clog.Logger.Info("backlog %d bytes, catchup: %v", backlog, catchup)
+			t.catchup = catchup
+			t.apply()
+		}
+		t.Unlock()
+	}
+}
+
+// etcd中保存JSON, 如 {"BytesPerSec": 1048576, "CatchupBytesPerSec": 4194304, "CatchupBacklog": 104857600}
+func (t *bandwidthThrottle) loadEtcd(etcd_addr, path string) error {
+	content, err := config.LoadContentFromEtcd(strings.Split(etcd_addr, ","), ETCD_SERVICE_NAME, path)
+	if nil != err {
+		return err
+	}
+	var cfg BandwidthConfig
+	if err = json.Unmarshal([]byte(content), &cfg); nil != err {
+		return err
+	}
+	if err = checkBandwidth(cfg); nil != err {
+		return err
+	}
+	cfg.EtcdPath = path
+	t.Set(cfg)
+	return nil
+}
+
+func (t *bandwidthThrottle) refreshEtcd(delivery DeliveryConfig, path string) {
+	interval := time.Duration(delivery.EtcdRefresh) * time.Second
+	if interval <= 0 {
+		interval = DEFAULT_ETCD_REFRESH * time.Second
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		if err := t.loadEtcd(delivery.EtcdAddr, path); nil != err {
+			clog.Logger.Error("refresh bandwidth from etcd err: %v", err)
+		}
+	}
+}
+
+// SetBandwidth 运行时修改带宽, 如收到SIGHUP后重新读取配置文件
+// 配置了etcd时以etcd为准, 下次刷新时会覆盖
+func SetBandwidth(cfg BandwidthConfig) error {
+	if err := checkBandwidth(cfg); nil != err {
+		return err
+	}
+	gThrottle.Set(cfg)
+	return nil
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zh4af/loggather/protocol"
+)
+
+const (
+	DEFAULT_BATCH_MAX_BYTES = 4 * 1024 * 1024 // 压缩后
+	DEFAULT_BATCH_LINGER    = 200             // 毫秒
+)
+
+// BatchConfig 同一时间段内各文件的数据合并成一次上报, MaxEntries大于1时启用
+type BatchConfig struct {
+	MaxEntries int // 单次最多条数, 不超过1000
+	MaxBytes   int // 单次压缩后数据总量上限, 默认4M
+	Linger     int // 前一批还在发送时, 新数据最多等待多少毫秒凑批, 默认200
+}
+
+type batchEntry struct {
+	report *protocol.LogGatherReport
+	result chan reportAck
+}
+
+type pendingBatch struct {
+	report_url string
+	entries    []*batchEntry
+	bytes      int
+	timer      *time.Timer
+}
+
+// batchQueue 发往同一处的数据, 同时只有一批在发送, 发送期间到达的数据合并成下一批
+type batchQueue struct {
+	sending bool
+	pending *pendingBatch
+}
+
+// reportBatcher 各采集流仍然同步等待自己那条数据的结果, 和单条上报的调用方式一样
+// 没有正在发送的批次时直接发送, 不等Linger; 批次在前一批发送期间凑成, 并发采集的文件越多批次越大
+type reportBatcher struct {
+	c   *reportClient
+	cfg BatchConfig
+
+	sync.Mutex
+	queues map[string]*batchQueue
+}
+
+func newReportBatcher(c *reportClient, cfg BatchConfig) *reportBatcher {
+	if cfg.MaxEntries <= 1 {
+		return nil
+	}
+	if cfg.MaxEntries > protocol.MAX_BATCH_ENTRIES {
+		cfg.MaxEntries = protocol.MAX_BATCH_ENTRIES
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DEFAULT_BATCH_MAX_BYTES
+	}
+	if cfg.Linger <= 0 {
+		cfg.Linger = DEFAULT_BATCH_LINGER
+	}
+	return &reportBatcher{c: c, cfg: cfg, queues: make(map[string]*batchQueue, 1)}
+}
+
+// Submit 加入一批并等待这一条的结果
+func (b *reportBatcher) Submit(report_url string, body *protocol.LogGatherReport) reportAck {
+	e := &batchEntry{report: body, result: make(chan reportAck, 1)}
+	key := b.batchKey(report_url, body.FileName)
+
+	b.Lock()
+	q := b.queues[key]
+	if q == nil {
+		q = &batchQueue{}
+		b.queues[key] = q
+	}
+	if !q.sending {
+		q.sending = true
+		b.Unlock()
+		go b.run(key, &pendingBatch{report_url: report_url, entries: []*batchEntry{e}, bytes: len(body.LogInfo)})
+		return <-e.result
+	}
+
+	pb := q.pending
+	if pb == nil {
+		pb = &pendingBatch{report_url: report_url}
+		q.pending = pb
+		// 前一批迟迟没有返回时, 最多等Linger就单独发出
+		pb.timer = time.AfterFunc(time.Duration(b.cfg.Linger)*time.Millisecond, func() {
+			b.flush(key, pb)
+		})
+	}
+	pb.entries = append(pb.entries, e)
+	pb.bytes += len(body.LogInfo)
+	if len(pb.entries) >= b.cfg.MaxEntries || pb.bytes >= b.cfg.MaxBytes {
+		q.pending = nil
+		pb.timer.Stop()
+		go b.send(pb)
+	}
+	b.Unlock()
+
+	return <-e.result
+}
+
+// 按hash分配服务端时, 只有发往同一台服务端的数据才合并, 保持文件和服务端的对应关系
+func (b *reportBatcher) batchKey(report_url, file_name string) string {
+	if b.c.pool.balance != BALANCE_HASH {
+		return report_url
+	}
+	return report_url + " " + b.c.pool.Candidates(report_url, file_name)[0]
+}
+
+// run 发送一批, 之后立即发送这期间凑成的下一批, 直到没有新的数据
+func (b *reportBatcher) run(key string, pb *pendingBatch) {
+	for pb != nil {
+		b.send(pb)
+
+		b.Lock()
+		q := b.queues[key]
+		pb = q.pending
+		q.pending = nil
+		if pb != nil {
+			pb.timer.Stop()
+		} else {
+			delete(b.queues, key)
+		}
+		b.Unlock()
+	}
+}
+
+func (b *reportBatcher) flush(key string, pb *pendingBatch) {
+	b.Lock()
+	q := b.queues[key]
+	if q == nil || q.pending != pb {
+		// 已经因为条数或大小提前发出, 或者随前一批之后发出
+		b.Unlock()
+		return
+	}
+	q.pending = nil
+	b.Unlock()
+	b.send(pb)
+}
+
+func (b *reportBatcher) send(pb *pendingBatch) {
+	if len(pb.entries) == 1 {
+		var ack reportAck
+		ack.committed, ack.err = b.c.Send(pb.report_url, pb.entries[0].report)
+		pb.entries[0].result <- ack
+		return
+	}
+
+	bodies := make([]*protocol.LogGatherReport, len(pb.entries))
+	for i, e := range pb.entries {
+		bodies[i] = e.report
+	}
+	for i, ack := range b.c.SendBatch(pb.report_url, bodies) {
+		pb.entries[i].result <- ack
+	}
+}
@@ -0,0 +1,247 @@
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"backend/common/clog"
+	"backend/common/config"
+	"backend/common/redisutil"
+	"third/redigo/redis"
+)
+
+const (
+	CHECKPOINT_BACKEND_FILE  = "file"
+	CHECKPOINT_BACKEND_REDIS = "redis"
+
+	LEGACY_RECORD_FILE      = "./log_record_info.json"
+	DEFAULT_CHECKPOINT_PATH = "/var/lib/loggather/log_record_info.json"
+	CHECKPOINT_REDIS_PREFIX = "loggather:checkpoint:"
+	AGENT_ID_FILE           = "agent_id" // 和进度文件放在同一个目录
+	AGENT_ID_REDIS_SUFFIX   = ":agent_id"
+)
+
+// CheckpointConfig 采集进度的保存方式
+type CheckpointConfig struct {
+	Backend string // file/redis, 默认file
+	Path    string // file: 进度文件路径, 默认/var/lib/loggather/log_record_info.json, 这个目录不能写入时(非root运行)用工作目录下的log_record_info.json
+	Redis   string // redis: RedisSetting中的配置名
+	Key     string // redis: 保存进度的key, 默认loggather:checkpoint:<hostname>
+}
+
+// CheckpointStore 进度存储, Save需要保证要么完整写入新内容, 要么保留旧内容
+// 客户端的AgentId也保存在这里, 进度和身份一起迁移
+type CheckpointStore interface {
+	Load() ([]byte, error)
+	Save(buf []byte) error
+	LoadAgentId() (string, error) // 还没有保存过时返回空字符串
+	SaveAgentId(id string) error
+	Close() error
+}
+
+var gCheckpoint CheckpointStore
+
+func newCheckpointStore(cfg CheckpointConfig) (CheckpointStore, error) {
+	switch cfg.Backend {
+	case "", CHECKPOINT_BACKEND_FILE:
+		path := cfg.Path
+		if path == "" {
+			path = defaultCheckpointPath()
+		}
+		path, err := filepath.Abs(path)
+		if nil != err {
+			return nil, err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0755); nil != err {
+			return nil, err
+		}
+		clog.Logger.Info("checkpoint file: %s", path)
+		return &fileCheckpoint{path: path}, nil
+	case CHECKPOINT_BACKEND_REDIS:
+		redis_cfg, ok := config.Config.RedisSetting[cfg.Redis]
+		if !ok {
+			return nil, errors.New("checkpoint redis setting not found: " + cfg.Redis)
+		}
+		key := cfg.Key
+		if key == "" {
+			host, err := os.Hostname()
+			if nil != err {
+				return nil, err
+			}
+			key = CHECKPOINT_REDIS_PREFIX + host
+		}
+		cache, err := redisutil.InitRedisPool(&redis_cfg)
+		if nil != err {
+			return nil, err
+		}
+		clog.Logger.Info("checkpoint redis: %s key: %s", redis_cfg.RedisConn, key)
+		return &redisCheckpoint{cache: cache, key: key}, nil
+	}
+	return nil, errors.New("unknown checkpoint backend: " + cfg.Backend)
+}
+
+var gDefaultCheckpoint struct {
+	sync.Once
+	path string
+}
+
+// 默认目录需要root权限, 不能创建或写入时和旧版本一样用工作目录
+func defaultCheckpointPath() string {
+	gDefaultCheckpoint.Do(func() {
+		gDefaultCheckpoint.path = DEFAULT_CHECKPOINT_PATH
+		err := checkDirWritable(filepath.Dir(DEFAULT_CHECKPOINT_PATH))
+		if nil == err {
+			return
+		}
+		legacy, abs_err := filepath.Abs(LEGACY_RECORD_FILE)
+		if nil != abs_err {
+			legacy = LEGACY_RECORD_FILE
+		}
+		clog.Logger.Warning("checkpoint dir: %s not writable: %v, use %s", filepath.Dir(DEFAULT_CHECKPOINT_PATH), err, legacy)
+		gDefaultCheckpoint.path = legacy
+	})
+	return gDefaultCheckpoint.path
+}
+
+func checkDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); nil != err {
+		return err
+	}
+	fp, err := ioutil.TempFile(dir, ".loggather")
+	if nil != err {
+		return err
+	}
+	fp.Close()
+	return os.Remove(fp.Name())
+}
+
+// Dir 进度文件所在的目录, 保存在redis时为默认的目录
+func (cfg CheckpointConfig) Dir() string {
+	path := defaultCheckpointPath()
+	if (cfg.Backend == "" || cfg.Backend == CHECKPOINT_BACKEND_FILE) && cfg.Path != "" {
+		path = cfg.Path
+	}
+	if abs, err := filepath.Abs(path); nil == err {
+		path = abs
+	}
+	return filepath.Dir(path)
+}
+
+// fileCheckpoint 先写临时文件并fsync, 再rename覆盖, 崩溃时只会留下旧的或新的完整文件
+type fileCheckpoint struct {
+	path string
+}
+
+func (c *fileCheckpoint) Load() ([]byte, error) {
+	buf, err := ioutil.ReadFile(c.path)
+	if nil == err || !os.IsNotExist(err) {
+		return buf, err
+	}
+
+	// 还没有进度文件时沿用旧版本工作目录下的记录
+	legacy, legacy_err := filepath.Abs(LEGACY_RECORD_FILE)
+	if nil != legacy_err || legacy == c.path {
+		return nil, nil
+	}
+	if buf, err = ioutil.ReadFile(legacy); nil != err {
+		return nil, nil
+	}
+	clog.Logger.Info("load checkpoint from legacy file: %s", legacy)
+	return buf, nil
+}
+
+func (c *fileCheckpoint) Save(buf []byte) error {
+	return writeFileAtomic(c.path, buf)
+}
+
+func (c *fileCheckpoint) LoadAgentId() (string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(filepath.Dir(c.path), AGENT_ID_FILE))
+	if nil != err {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+func (c *fileCheckpoint) SaveAgentId(id string) error {
+	return writeFileAtomic(filepath.Join(filepath.Dir(c.path), AGENT_ID_FILE), []byte(id+"\n"))
+}
+
+func writeFileAtomic(path string, buf []byte) error {
+	tmp := path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if nil != err {
+		return err
+	}
+	if _, err = fp.Write(buf); nil == err {
+		err = fp.Sync()
+	}
+	if close_err := fp.Close(); nil == err {
+		err = close_err
+	}
+	if nil != err {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, path); nil != err {
+		return err
+	}
+
+	// rename本身也要落盘, 部分平台不支持对目录fsync, 忽略错误
+	if dir, err := os.Open(filepath.Dir(path)); nil == err {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (c *fileCheckpoint) Close() error {
+	return nil
+}
+
+// redisCheckpoint 进度保存在redis中, 主机重建后仍能恢复
+type redisCheckpoint struct {
+	cache *redisutil.Cache
+	key   string
+}
+
+func (c *redisCheckpoint) Load() ([]byte, error) {
+	buf, err := c.cache.Get(c.key)
+	if nil != err {
+		if err == redis.ErrNil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (c *redisCheckpoint) Save(buf []byte) error {
+	// SET单条命令, 不会出现写了一半的值
+	return c.cache.Set(c.key, buf, -1)
+}
+
+func (c *redisCheckpoint) LoadAgentId() (string, error) {
+	buf, err := c.cache.Get(c.key + AGENT_ID_REDIS_SUFFIX)
+	if nil != err {
+		if err == redis.ErrNil {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (c *redisCheckpoint) SaveAgentId(id string) error {
+	return c.cache.Set(c.key+AGENT_ID_REDIS_SUFFIX, id, -1)
+}
+
+func (c *redisCheckpoint) Close() error {
+	return c.cache.RedisPool().Close()
+}
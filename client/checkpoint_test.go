@@ -0,0 +1,39 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDirWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loggather")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(file, nil, 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		dir     string
+		wantErr bool
+	}{
+		{"existing", dir, false},
+		{"created", filepath.Join(dir, "a", "b"), false},
+		{"under a file", filepath.Join(file, "a"), true},
+	}
+	for _, c := range cases {
+		if err := checkDirWritable(c.dir); (nil != err) != c.wantErr {
+			t.Errorf("%s: checkDirWritable err: %v, want err: %v", c.name, err, c.wantErr)
+		}
+	}
+	// 检查用的临时文件不留下
+	if names, _ := ioutil.ReadDir(dir); len(names) != 2 {
+		t.Errorf("dir has %d entries after check, want 2", len(names))
+	}
+}
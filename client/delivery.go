@@ -0,0 +1,631 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"backend/common/clog"
+	"github.com/zh4af/loggather/protocol"
+	"third/go-metrics"
+	"third/go-resiliency/breaker"
+)
+
+const (
+	DEFAULT_REPORT_TIMEOUT      = 10    // 秒
+	DEFAULT_REPORT_RETRIES      = 3     // 次
+	DEFAULT_BACKOFF_BASE        = 500   // 毫秒
+	DEFAULT_BACKOFF_MAX         = 30000 // 毫秒
+	DEFAULT_BREAKER_ERRORS      = 5
+	DEFAULT_BREAKER_SUCCESSES   = 2
+	DEFAULT_BREAKER_OPEN_PERIOD = 30 // 秒
+
+	BREAKER_CLOSED   = 0
+	BREAKER_OPEN     = 1
+	BREAKER_HALFOPEN = 2
+)
+
+var breakerStateNames = []string{"closed", "open", "half-open"}
+
+// 服务端明确拒绝(4xx), 重试也不会成功, 也不算服务端故障
+var errReportRejected = errors.New("report rejected by server")
+
+// 服务端解压后的数据和校验和对不上, 重发即可
+var errChecksumMismatch = errors.New("report checksum mismatch")
+
+var gChecksumMismatchCount = metrics.GetOrRegisterCounter("report.checksum_mismatch", nil)
+
+// offsetConflictError 数据和服务端已确认的位置对不上, 客户端从committed处重新读取
+type offsetConflictError struct {
+	file      string
+	committed int64
+	msg       string
+}
+
+func (e *offsetConflictError) Error() string {
+	return fmt.Sprintf("report file: %s conflict, committed %d: %s", e.file, e.committed, e.msg)
+}
+
+// reportAck 单条上报的结果, committed为服务端确认已写入的源文件位置, 采集进度只推进到这里
+type reportAck struct {
+	committed int64
+	err       error
+}
+
+// 服务端正常处理了请求, 只是不接受这条数据, 不重试也不计入熔断
+func serverAnswered(err error) bool {
+	if err == errReportRejected {
+		return true
+	}
+	_, ok := err.(*offsetConflictError)
+	return ok
+}
+
+// DeliveryConfig 上报的超时, 重试和熔断
+type DeliveryConfig struct {
+	Timeout          int // 单次请求超时(秒), 默认10
+	Retries          int // 单批数据失败后重试次数, 默认3, 仍失败时落盘
+	BackoffBase      int // 第一次重试前的等待(毫秒), 之后每次翻倍并加随机抖动, 默认500
+	BackoffMax       int // 重试等待上限(毫秒), 默认30000
+	BreakerErrors    int // 连续失败多少次后熔断, 默认5
+	BreakerSuccesses int // 半开状态连续成功多少次后恢复, 默认2
+	BreakerOpen      int // 熔断多少秒后放行试探请求, 默认30
+
+	Servers     []string // 服务端地址列表, 替换ReportUrl中的地址, 路径不变; 不配置时直接使用ReportUrl
+	EtcdAddr    string   // etcd地址, 逗号分隔, 和EtcdPath一起配置时从etcd读取服务端列表
+	EtcdPath    string   // 服务端列表在etcd中的路径, 实际key为 /config/loggather/<EtcdPath>
+	EtcdRefresh int      // etcd列表刷新间隔(秒), 默认60
+	Balance     string   // hash(默认, 按文件名固定服务端)/roundrobin
+
+	Encoding string // json(默认, v1接口)/binary/msgpack(v2接口, 需要服务端也已升级)
+	Checksum string // 解压后数据的校验和: crc32c(默认)/xxhash32/none
+
+	Transport string // http(默认)/tcp, tcp时Servers(或etcd列表)配置服务端RpcListen的地址
+
+	Batch BatchConfig // 多个文件的数据合并上报
+}
+
+// reportTarget 一个上报地址, 各自熔断
+type reportTarget struct {
+	host       string
+	breaker    *breaker.Breaker
+	stateGauge metrics.Gauge
+
+	sync.Mutex
+	state     int
+	successes int
+}
+
+type reportClient struct {
+	cfg    DeliveryConfig
+	client *http.Client
+	pool   *serverPool
+	stream *streamPool // Transport为tcp时使用
+
+	sync.Mutex
+	targets map[string]*reportTarget // key: host
+	batcher *reportBatcher           // 配置了批量上报时使用
+
+	retryCount  metrics.Counter
+	failCount   metrics.Counter
+	rejectCount metrics.Counter // 熔断期间直接拒绝的请求
+	sentCount   metrics.Counter // 服务端确认的字节数(压缩后), 包括落盘重发的
+	latency     metrics.Timer   // 每次请求的耗时, 批量请求算一次
+}
+
+var gReporter *reportClient
+
+func newReportClient(cfg DeliveryConfig) (*reportClient, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DEFAULT_REPORT_TIMEOUT
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	} else if cfg.Retries == 0 {
+		cfg.Retries = DEFAULT_REPORT_RETRIES
+	}
+	if cfg.BackoffBase <= 0 {
+		cfg.BackoffBase = DEFAULT_BACKOFF_BASE
+	}
+	if cfg.BackoffMax <= 0 {
+		cfg.BackoffMax = DEFAULT_BACKOFF_MAX
+	}
+	if cfg.BreakerErrors <= 0 {
+		cfg.BreakerErrors = DEFAULT_BREAKER_ERRORS
+	}
+	if cfg.BreakerSuccesses <= 0 {
+		cfg.BreakerSuccesses = DEFAULT_BREAKER_SUCCESSES
+	}
+	if cfg.BreakerOpen <= 0 {
+		cfg.BreakerOpen = DEFAULT_BREAKER_OPEN_PERIOD
+	}
+	switch cfg.Encoding {
+	case "":
+		cfg.Encoding = protocol.ENCODING_JSON
+	case protocol.ENCODING_JSON, protocol.ENCODING_BINARY, protocol.ENCODING_MSGPACK:
+	default:
+		return nil, protocol.ErrUnknownEncoding
+	}
+	if cfg.Checksum == "" {
+		cfg.Checksum = protocol.CHECKSUM_CRC32C
+	}
+	if err := protocol.CheckChecksumAlgo(cfg.Checksum); nil != err {
+		return nil, err
+	}
+
+	pool, err := newServerPool(cfg)
+	if nil != err {
+		return nil, err
+	}
+	var stream *streamPool
+	switch cfg.Transport {
+	case "", TRANSPORT_HTTP:
+	case TRANSPORT_TCP:
+		if len(cfg.Servers) == 0 && cfg.EtcdPath == "" {
+			return nil, errors.New("tcp transport needs Servers or EtcdPath")
+		}
+		stream = newStreamPool(time.Duration(cfg.Timeout) * time.Second)
+	default:
+		return nil, errors.New("unknown transport: " + cfg.Transport)
+	}
+
+	c := &reportClient{
+		cfg:         cfg,
+		client:      &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		pool:        pool,
+		stream:      stream,
+		targets:     make(map[string]*reportTarget, 1),
+		retryCount:  metrics.GetOrRegisterCounter("report.retries", nil),
+		failCount:   metrics.GetOrRegisterCounter("report.failures", nil),
+		rejectCount: metrics.GetOrRegisterCounter("report.breaker_rejected", nil),
+		sentCount:   metrics.GetOrRegisterCounter("report.bytes_sent", nil),
+		latency:     metrics.GetOrRegisterTimer("report.latency", nil),
+	}
+	c.batcher = newReportBatcher(c, cfg.Batch)
+	return c, nil
+}
+
+// 熔断按服务端区分, 同一台服务端的单条和批量上报共用
+func (c *reportClient) target(report_url string) *reportTarget {
+	host := report_url
+	if u, err := url.Parse(report_url); nil == err && u.Host != "" {
+		host = u.Host
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	t, ok := c.targets[host]
+	if !ok {
+		t = &reportTarget{
+			host:       host,
+			breaker:    breaker.New(c.cfg.BreakerErrors, c.cfg.BreakerSuccesses, time.Duration(c.cfg.BreakerOpen)*time.Second),
+			stateGauge: metrics.GetOrRegisterGauge("report.breaker."+host, nil),
+		}
+		c.targets[host] = t
+	}
+	return t
+}
+
+// Deliver 发送一批数据, 所有服务端都失败后按指数退避重试, 全部熔断时立即返回
+// 成功时返回服务端确认的源文件位置
+func (c *reportClient) Deliver(report_url string, body *protocol.LogGatherReport) (int64, error) {
+	var ack reportAck
+	for attempt := 0; ; attempt++ {
+		gThrottle.Wait(len(body.LogInfo))
+		if c.batcher != nil {
+			ack = c.batcher.Submit(report_url, body)
+		} else {
+			ack.committed, ack.err = c.Send(report_url, body)
+		}
+		if nil == ack.err {
+			c.sentCount.Inc(int64(len(body.LogInfo)))
+			return ack.committed, nil
+		}
+		if ack.err == breaker.ErrBreakerOpen || serverAnswered(ack.err) || attempt >= c.cfg.Retries {
+			return 0, ack.err
+		}
+		c.retryCount.Inc(1)
+		time.Sleep(c.Backoff(attempt))
+	}
+}
+
+// Send 按优先顺序尝试各个服务端, 直到有一个成功
+// 所有服务端都熔断时返回breaker.ErrBreakerOpen
+func (c *reportClient) Send(report_url string, body *protocol.LogGatherReport) (int64, error) {
+	var last_err error
+	report_url = c.endpoint(report_url)
+	for _, target_url := range c.pool.Candidates(report_url, body.FileName) {
+		committed, err := c.Post(target_url, body)
+		if nil == err || serverAnswered(err) {
+			return committed, err
+		}
+		if err != breaker.ErrBreakerOpen {
+			clog.Logger.Warning("report file: %s to %s err: %v", body.FileName, target_url, err)
+			last_err = err
+		}
+	}
+	if last_err == nil {
+		return 0, breaker.ErrBreakerOpen
+	}
+	return 0, last_err
+}
+
+// Post 经过熔断器发送一次
+func (c *reportClient) Post(target_url string, body *protocol.LogGatherReport) (int64, error) {
+	var committed int64
+	err := c.call(target_url, func(t *reportTarget) error {
+		var err error
+		if c.stream != nil {
+			committed, err = c.stream.Post(t.host, body)
+		} else {
+			committed, err = c.post(target_url, body)
+		}
+		return err
+	})
+	return committed, err
+}
+
+// SendBatch 多个文件的数据一次发送, 返回逐条的结果, 请求失败时换下一个服务端
+func (c *reportClient) SendBatch(report_url string, bodies []*protocol.LogGatherReport) []reportAck {
+	var results []reportAck
+	var last_err error
+	batch_url := c.batchEndpoint(report_url)
+	for _, target_url := range c.pool.Candidates(batch_url, bodies[0].FileName) {
+		err := c.call(target_url, func(t *reportTarget) error {
+			var err error
+			if c.stream != nil {
+				results, err = c.stream.PostBatch(t.host, bodies)
+			} else {
+				results, err = c.postBatch(target_url, bodies)
+			}
+			return err
+		})
+		if nil == err {
+			return results
+		}
+		if err == errReportRejected {
+			last_err = err
+			break
+		}
+		if err != breaker.ErrBreakerOpen {
+			clog.Logger.Warning("report batch of %d to %s err: %v", len(bodies), target_url, err)
+			last_err = err
+		}
+	}
+	if last_err == nil {
+		last_err = breaker.ErrBreakerOpen
+	}
+	results = make([]reportAck, len(bodies))
+	for i := range results {
+		results[i].err = last_err
+	}
+	return results
+}
+
+// 服务端处理了请求, 不计入熔断; 校验和不一致是传输中出错, 仍然重试
+func serverHealthy(err error) bool {
+	return nil == err || serverAnswered(err) || err == errChecksumMismatch
+}
+
+// call 经过熔断器调用一次, 服务端拒绝, 位置冲突或校验和不一致都说明服务端正常, 不计入熔断
+func (c *reportClient) call(target_url string, work func(t *reportTarget) error) error {
+	t := c.target(target_url)
+
+	var work_err error
+	err := t.breaker.Run(func() error {
+		t.observeAttempt()
+		start := time.Now()
+		work_err = work(t)
+		c.latency.UpdateSince(start)
+		if serverHealthy(work_err) {
+			return nil
+		}
+		return work_err
+	})
+	if err == breaker.ErrBreakerOpen {
+		c.rejectCount.Inc(1)
+		t.setState(BREAKER_OPEN)
+		return err
+	}
+	t.observeResult(serverHealthy(work_err), c.cfg.BreakerSuccesses)
+	if nil != work_err {
+		c.failCount.Inc(1)
+	}
+	return work_err
+}
+
+// Backoff 第attempt次失败后的等待时间, 在[d/2, d]之间随机, 避免多个客户端同时重试
+func (c *reportClient) Backoff(attempt int) time.Duration {
+	d := time.Duration(c.cfg.BackoffBase) * time.Millisecond
+	max := time.Duration(c.cfg.BackoffMax) * time.Millisecond
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// 解压后数据的校验和, 配置为none时不带
+func (c *reportClient) checksum(data []byte) (string, uint32) {
+	if c.cfg.Checksum == protocol.CHECKSUM_NONE {
+		return "", 0
+	}
+	sum, _ := protocol.Checksum(c.cfg.Checksum, data)
+	return c.cfg.Checksum, sum
+}
+
+// v2编码发往对应的v2接口
+func (c *reportClient) endpoint(report_url string) string {
+	if c.cfg.Encoding == protocol.ENCODING_JSON || c.stream != nil {
+		return report_url
+	}
+	u, err := url.Parse(report_url)
+	if nil != err {
+		return report_url
+	}
+	u.Path = protocol.ReportPathV2(u.Path)
+	return u.String()
+}
+
+// 批量上报: json发往v1的batch接口, 其他编码用msgpack发往v2的batch接口
+func (c *reportClient) batchEndpoint(report_url string) string {
+	u, err := url.Parse(report_url)
+	if nil != err {
+		return report_url
+	}
+	u.Path = protocol.BatchPath(u.Path)
+	if c.cfg.Encoding != protocol.ENCODING_JSON && c.stream == nil {
+		u.Path = protocol.ReportPathV2(u.Path)
+	}
+	return u.String()
+}
+
+func (c *reportClient) postBatch(batch_url string, bodies []*protocol.LogGatherReport) ([]reportAck, error) {
+	batch := newBatch(bodies)
+
+	var b []byte
+	var err error
+	content_type := protocol.CONTENT_TYPE_JSON
+	if c.cfg.Encoding == protocol.ENCODING_JSON {
+		b, err = json.Marshal(batch)
+	} else {
+		b, err = protocol.EncodeMsgpack(batch)
+		content_type = protocol.CONTENT_TYPE_MSGPACK
+	}
+	if nil != err {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", batch_url, bytes.NewReader(b))
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", content_type)
+	rsp, err := c.client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	rsp_body, err := ioutil.ReadAll(rsp.Body)
+	if nil != err {
+		return nil, err
+	}
+	if rsp.StatusCode >= 400 && rsp.StatusCode < 500 {
+		clog.Logger.Error("report batch of %d http status: %d", len(bodies), rsp.StatusCode)
+		return nil, errReportRejected
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("report batch http status: %d", rsp.StatusCode)
+	}
+
+	var api_rsp struct {
+		Data protocol.LogGatherResp `json:"data"`
+	}
+	if err = json.Unmarshal(rsp_body, &api_rsp); nil != err {
+		return nil, err
+	}
+	return batchResults(bodies, api_rsp.Data.Results)
+}
+
+// 客户端信息放在批次上, 条目中不再重复
+func newBatch(bodies []*protocol.LogGatherReport) *protocol.LogGatherBatch {
+	batch := &protocol.LogGatherBatch{
+		Agent:   bodies[0].Agent,
+		Entries: make([]protocol.LogGatherReport, len(bodies)),
+	}
+	for i := range bodies {
+		batch.Entries[i] = *bodies[i]
+		batch.Entries[i].Agent = protocol.AgentInfo{}
+	}
+	return batch
+}
+
+// 服务端逐条的结果, 条数对不上时整批视为失败
+func batchResults(bodies []*protocol.LogGatherReport, results []protocol.LogGatherResult) ([]reportAck, error) {
+	if len(results) != len(bodies) {
+		return nil, fmt.Errorf("batch results %d != entries %d", len(results), len(bodies))
+	}
+	acks := make([]reportAck, len(results))
+	for i, r := range results {
+		acks[i] = resultAck(bodies[i], r)
+	}
+	return acks, nil
+}
+
+// 只按服务端返回的位置推进, 返回0时从头重读, 由服务端去重; 旧版本服务端没有结果, 在legacyResponse中处理
+func resultAck(body *protocol.LogGatherReport, r protocol.LogGatherResult) reportAck {
+	return reportAck{committed: r.Committed, err: resultError(body.FileName, r)}
+}
+
+func resultError(file_name string, r protocol.LogGatherResult) error {
+	if r.Code == http.StatusConflict {
+		return &offsetConflictError{file: file_name, committed: r.Committed, msg: r.Msg}
+	}
+	if r.Code == protocol.CODE_CHECKSUM_MISMATCH {
+		clog.Logger.Warning("report file: %s checksum mismatch: %s", file_name, r.Msg)
+		gChecksumMismatchCount.Inc(1)
+		return errChecksumMismatch
+	}
+	if r.Code >= 400 && r.Code < 500 {
+		clog.Logger.Error("report file: %s rejected: %d %s", file_name, r.Code, r.Msg)
+		return errReportRejected
+	}
+	if r.Code != http.StatusOK {
+		return fmt.Errorf("report file: %s result: %d %s", file_name, r.Code, r.Msg)
+	}
+	return nil
+}
+
+func (c *reportClient) newRequest(report_url string, body *protocol.LogGatherReport) (*http.Request, error) {
+	var b []byte
+	var err error
+	var content_type string
+
+	switch c.cfg.Encoding {
+	case protocol.ENCODING_BINARY:
+		b, content_type = body.LogInfo, protocol.CONTENT_TYPE_BINARY
+	case protocol.ENCODING_MSGPACK:
+		b, err = protocol.EncodeMsgpack(body)
+		content_type = protocol.CONTENT_TYPE_MSGPACK
+	default:
+		b, err = json.Marshal(body)
+		content_type = protocol.CONTENT_TYPE_JSON
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", report_url, bytes.NewReader(b))
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", content_type)
+	if c.cfg.Encoding == protocol.ENCODING_BINARY {
+		req.Header.Set(protocol.HEADER_FILE_NAME, url.PathEscape(body.FileName))
+		req.Header.Set(protocol.HEADER_CODEC, body.Codec)
+		req.Header.Set(protocol.HEADER_AGENT_ID, body.Agent.AgentId)
+		req.Header.Set(protocol.HEADER_HOSTNAME, url.PathEscape(body.Agent.Hostname))
+		req.Header.Set(protocol.HEADER_IP, body.Agent.Ip)
+		req.Header.Set(protocol.HEADER_VERSION, body.Agent.Version)
+		req.Header.Set(protocol.HEADER_FILE_ID, body.FileId)
+		req.Header.Set(protocol.HEADER_OFFSET, strconv.FormatInt(body.Offset, 10))
+		req.Header.Set(protocol.HEADER_END, strconv.FormatInt(body.End, 10))
+		if body.ChecksumAlgo != "" {
+			req.Header.Set(protocol.HEADER_CHECKSUM, body.ChecksumAlgo+":"+strconv.FormatUint(uint64(body.Checksum), 10))
+		}
+	}
+	return req, nil
+}
+
+func (c *reportClient) post(report_url string, body *protocol.LogGatherReport) (int64, error) {
+	req, err := c.newRequest(report_url, body)
+	if nil != err {
+		return 0, err
+	}
+	rsp, err := c.client.Do(req)
+	if nil != err {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+	rsp_body, err := ioutil.ReadAll(rsp.Body)
+	if nil != err {
+		return 0, err
+	}
+	if rsp.StatusCode == protocol.CODE_CHECKSUM_MISMATCH {
+		clog.Logger.Warning("report file: %s checksum mismatch", body.FileName)
+		gChecksumMismatchCount.Inc(1)
+		return 0, errChecksumMismatch
+	}
+	if rsp.StatusCode >= 400 && rsp.StatusCode < 500 {
+		clog.Logger.Error("report file: %s http status: %d", body.FileName, rsp.StatusCode)
+		return 0, errReportRejected
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("report http status: %d", rsp.StatusCode)
+	}
+
+	var api_rsp struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err = json.Unmarshal(rsp_body, &api_rsp); nil != err {
+		return 0, fmt.Errorf("report file: %s invalid response: %v", body.FileName, err)
+	}
+	if legacyResponse(api_rsp.Status, api_rsp.Data) {
+		return body.End, nil
+	}
+	var data protocol.LogGatherResp
+	if err = json.Unmarshal(api_rsp.Data, &data); nil != err {
+		return 0, fmt.Errorf("report file: %s invalid response data: %v", body.FileName, err)
+	}
+	if len(data.Results) != 1 {
+		return 0, fmt.Errorf("report file: %s got %d results", body.FileName, len(data.Results))
+	}
+	ack := resultAck(body, data.Results[0])
+	return ack.committed, ack.err
+}
+
+// 旧版本服务端成功时返回{"status":"OK","data":{}}, 没有结果, 只能认为整块都已写入
+// 其他没有结果的响应都当作失败, 不移动读取位置
+func legacyResponse(status string, data json.RawMessage) bool {
+	if status != "OK" {
+		return false
+	}
+	d := bytes.TrimSpace(data)
+	return len(d) == 0 || bytes.Equal(d, []byte("null")) || bytes.Equal(d, []byte("{}"))
+}
+
+// 熔断器不对外暴露状态, 按请求结果推算: 被拒绝说明已熔断, 熔断后又放行说明进入半开
+func (t *reportTarget) observeAttempt() {
+	t.Lock()
+	defer t.Unlock()
+	if t.state == BREAKER_OPEN {
+		t.changeState(BREAKER_HALFOPEN)
+	}
+}
+
+func (t *reportTarget) observeResult(ok bool, successes int) {
+	t.Lock()
+	defer t.Unlock()
+	if t.state != BREAKER_HALFOPEN {
+		return
+	}
+	if !ok {
+		t.changeState(BREAKER_OPEN)
+		return
+	}
+	t.successes++
+	if t.successes >= successes {
+		t.changeState(BREAKER_CLOSED)
+	}
+}
+
+func (t *reportTarget) setState(state int) {
+	t.Lock()
+	defer t.Unlock()
+	t.changeState(state)
+}
+
+// 调用方需持有t的锁
+func (t *reportTarget) changeState(state int) {
+	if t.state == state {
+		return
+	}
+	if state == BREAKER_CLOSED {
+		clog.Logger.Info("report to %s breaker %s -> %s", t.host, breakerStateNames[t.state], breakerStateNames[state])
+	} else {
+		clog.Logger.Warning("report to %s breaker %s -> %s", t.host, breakerStateNames[t.state], breakerStateNames[state])
+	}
+	t.state = state
+	t.successes = 0
+	t.stateGauge.Update(int64(state))
+}
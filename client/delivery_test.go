@@ -0,0 +1,147 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zh4af/loggather/protocol"
+)
+
+func TestResultError(t *testing.T) {
+	cases := []struct {
+		name         string
+		result       protocol.LogGatherResult
+		wantConflict int64 // 大于等于0时期望offsetConflictError, 值为服务端已确认的位置
+		wantErr      error
+	}{
+		{"ok", protocol.LogGatherResult{Code: http.StatusOK, Committed: 200}, -1, nil},
+		{"gap", protocol.LogGatherResult{Code: http.StatusConflict, Committed: 50, Msg: "gap"}, 50, nil},
+		{"overlap", protocol.LogGatherResult{Code: http.StatusConflict, Committed: 150, Msg: "overlap"}, 150, nil},
+		{"rejected", protocol.LogGatherResult{Code: http.StatusBadRequest}, -1, errReportRejected},
+		{"checksum mismatch", protocol.LogGatherResult{Code: protocol.CODE_CHECKSUM_MISMATCH}, -1, errChecksumMismatch},
+	}
+	for _, c := range cases {
+		err := resultError("app.log", c.result)
+		if c.wantConflict >= 0 {
+			conflict, ok := err.(*offsetConflictError)
+			if !ok || conflict.committed != c.wantConflict {
+				t.Errorf("%s: err %v, want conflict at %d", c.name, err, c.wantConflict)
+			}
+			continue
+		}
+		if err != c.wantErr {
+			t.Errorf("%s: err %v, want %v", c.name, err, c.wantErr)
+		}
+	}
+}
+
+func TestResultAck(t *testing.T) {
+	body := &protocol.LogGatherReport{FileName: "app.log", Offset: 100, End: 200}
+	cases := []struct {
+		name          string
+		result        protocol.LogGatherResult
+		wantCommitted int64
+		wantErr       bool
+	}{
+		{"ok", protocol.LogGatherResult{Code: http.StatusOK, Committed: 200}, 200, false},
+		{"ok partial", protocol.LogGatherResult{Code: http.StatusOK, Committed: 150}, 150, false},
+		// 新版本服务端的结果只按返回的位置推进, 不当作整块已写入
+		{"ok without committed", protocol.LogGatherResult{Code: http.StatusOK}, 0, false},
+		{"duplicate", protocol.LogGatherResult{Code: http.StatusOK, Committed: 300}, 300, false},
+		{"conflict", protocol.LogGatherResult{Code: http.StatusConflict, Committed: 50, Msg: "gap"}, 50, true},
+		{"rejected", protocol.LogGatherResult{Code: http.StatusBadRequest}, 0, true},
+		{"checksum mismatch", protocol.LogGatherResult{Code: protocol.CODE_CHECKSUM_MISMATCH}, 0, true},
+	}
+	for _, c := range cases {
+		ack := resultAck(body, c.result)
+		if ack.committed != c.wantCommitted || (nil != ack.err) != c.wantErr {
+			t.Errorf("%s: ack %d, %v, want %d, err: %v", c.name, ack.committed, ack.err, c.wantCommitted, c.wantErr)
+		}
+	}
+}
+
+// testPost 用status和rsp应答一次单条上报, 返回post的结果
+func testPost(t *testing.T, status int, rsp string) (int64, error) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, rsp)
+	}))
+	defer srv.Close()
+	rc, err := newReportClient(DeliveryConfig{Servers: []string{srv.URL}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	body := &protocol.LogGatherReport{FileName: "app.log", FileId: "f1", Offset: 100, End: 200}
+	return rc.post(srv.URL+"/loggather/report", body)
+}
+
+func TestPost(t *testing.T) {
+	cases := []struct {
+		name          string
+		status        int
+		rsp           string
+		wantCommitted int64
+		wantErr       error
+	}{
+		{"ok", http.StatusOK, `{"status":"OK","data":{"results":[{"code":200,"committed":200}]}}`, 200, nil},
+		{"partial", http.StatusOK, `{"status":"OK","data":{"results":[{"code":200,"committed":150}]}}`, 150, nil},
+		{"committed 0", http.StatusOK, `{"status":"OK","data":{"results":[{"code":200,"committed":0}]}}`, 0, nil},
+		// 旧版本服务端没有返回结果, 整块视为已写入
+		{"legacy", http.StatusOK, `{"status":"OK","data":{},"desc":"success"}`, 200, nil},
+		{"rejected", http.StatusBadRequest, `Bad Request`, 0, errReportRejected},
+		// 校验和不对时不论是http状态码还是结果中的code, 都由调用方重发
+		{"checksum status", protocol.CODE_CHECKSUM_MISMATCH, `Unprocessable Entity`, 0, errChecksumMismatch},
+		{"checksum result", http.StatusOK, `{"status":"OK","data":{"results":[{"code":422,"msg":"checksum mismatch"}]}}`, 0, errChecksumMismatch},
+	}
+	for _, c := range cases {
+		committed, err := testPost(t, c.status, c.rsp)
+		if committed != c.wantCommitted || err != c.wantErr {
+			t.Errorf("%s: post = %d, %v, want %d, %v", c.name, committed, err, c.wantCommitted, c.wantErr)
+		}
+	}
+}
+
+// 只有旧版本服务端的成功响应按整块写入处理, 其他没有结果的响应都是错误, 读取位置不动
+func TestPostLegacyResponse(t *testing.T) {
+	cases := []struct {
+		name          string
+		rsp           string
+		wantCommitted int64
+		wantErr       bool
+	}{
+		{"legacy", `{"status":"OK","data":{},"desc":"success"}`, 200, false},
+		{"legacy without data", `{"status":"OK","desc":"success"}`, 200, false},
+		{"legacy null data", `{"status":"OK","data":null}`, 200, false},
+		{"not json", `<html>bad gateway</html>`, 0, true},
+		{"empty body", ``, 0, true},
+		{"status error", `{"status":"Error","data":1001,"desc":"failed"}`, 0, true},
+		{"empty results", `{"status":"OK","data":{"results":[]}}`, 0, true},
+		{"too many results", `{"status":"OK","data":{"results":[{"code":200},{"code":200}]}}`, 0, true},
+		{"bad data", `{"status":"OK","data":"ok"}`, 0, true},
+	}
+	for _, c := range cases {
+		committed, err := testPost(t, http.StatusOK, c.rsp)
+		if committed != c.wantCommitted || (nil != err) != c.wantErr {
+			t.Errorf("%s: post = %d, %v, want %d, err: %v", c.name, committed, err, c.wantCommitted, c.wantErr)
+		}
+	}
+}
+
+// 服务端确认的位置在前面时回退重读, 在后面时跳过
+func TestConflictOffset(t *testing.T) {
+	cases := []struct {
+		stpos, committed int64
+	}{
+		{100, 50},
+		{100, 150},
+		{100, 0},
+	}
+	for _, c := range cases {
+		conflict := &offsetConflictError{file: "app.log", committed: c.committed}
+		if got := conflictOffset("app.log", c.stpos, conflict); got != c.committed {
+			t.Errorf("conflictOffset(%d, %d) = %d", c.stpos, c.committed, got)
+		}
+	}
+}
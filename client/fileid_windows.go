@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"hash/crc32"
+	"os"
+	"syscall"
+)
+
+// windows下用卷序列号和文件索引代替dev和inode, 同一个卷上改名后不变
+// 取不到时用完整路径代替, 不支持跟踪改名
+func fileIdentity(path string, fi os.FileInfo) (dev uint64, ino uint64) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if nil != err {
+		return 0, uint64(crc32.ChecksumIEEE([]byte(path)))
+	}
+	h, err := syscall.CreateFile(p, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if nil != err {
+		return 0, uint64(crc32.ChecksumIEEE([]byte(path)))
+	}
+	defer syscall.CloseHandle(h)
+
+	var info syscall.ByHandleFileInformation
+	if err = syscall.GetFileInformationByHandle(h, &info); nil != err {
+		return 0, uint64(crc32.ChecksumIEEE([]byte(path)))
+	}
+	return uint64(info.VolumeSerialNumber), uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow)
+}
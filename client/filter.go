@@ -0,0 +1,106 @@
+package client
+
+import (
+	"errors"
+	"regexp"
+
+	"third/go-metrics"
+)
+
+// clog的级别前缀, 文件中可能带颜色控制符, 如 \x1b[33mWARN:2017-01-01 ...
+var clogLevelPattern = regexp.MustCompile(`^(\x1b\[[0-9;]*m)?(DEBU|INFO|NOTI|WARN|ERRO|CRIT):`)
+
+var clogLevels = map[string]int{
+	"DEBU": 0,
+	"INFO": 1,
+	"NOTI": 2,
+	"WARN": 3,
+	"ERRO": 4,
+	"CRIT": 5,
+}
+
+// FilterConfig 发送前按事件过滤, 多行事件按整个事件判断
+type FilterConfig struct {
+	Include  []string // 配置后只发送匹配其中任意一条的事件
+	Exclude  []string // 匹配其中任意一条的事件丢弃, 优先于Include
+	MinLevel string   // DEBU/INFO/NOTI/WARN/ERRO/CRIT, 低于该级别的clog日志丢弃, 没有级别前缀的事件不按级别过滤
+}
+
+type eventFilter struct {
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+	minLevel int
+
+	matchedCount metrics.Counter
+	droppedCount metrics.Counter
+}
+
+func newEventFilter(input string, cfg *FilterConfig) (*eventFilter, error) {
+	var err error
+
+	if cfg == nil {
+		return nil, nil
+	}
+	f := &eventFilter{
+		matchedCount: metrics.GetOrRegisterCounter("filter."+input+".matched", nil),
+		droppedCount: metrics.GetOrRegisterCounter("filter."+input+".dropped", nil),
+	}
+	if f.include, err = compilePatterns(cfg.Include); nil != err {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns(cfg.Exclude); nil != err {
+		return nil, err
+	}
+	if cfg.MinLevel != "" {
+		level, ok := clogLevels[cfg.MinLevel]
+		if !ok {
+			return nil, errors.New("unknown level: " + cfg.MinLevel)
+		}
+		f.minLevel = level
+	}
+	return f, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	list := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if nil != err {
+			return nil, err
+		}
+		list = append(list, re)
+	}
+	return list, nil
+}
+
+// Keep 事件是否需要发送
+func (f *eventFilter) Keep(event []byte) bool {
+	if f.match(event) {
+		f.matchedCount.Inc(1)
+		return true
+	}
+	f.droppedCount.Inc(1)
+	return false
+}
+
+func (f *eventFilter) match(event []byte) bool {
+	if f.minLevel > 0 {
+		if m := clogLevelPattern.FindSubmatch(event); m != nil && clogLevels[string(m[2])] < f.minLevel {
+			return false
+		}
+	}
+	for _, re := range f.exclude {
+		if re.Match(event) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.Match(event) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,15 +2,11 @@ package client
 
 import (
 	"bytes"
-	"compress/gzip"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
+	"io"
 	"os"
-	"os/exec"
-	"strings"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// "blast/common/util"
@@ -25,146 +21,393 @@ const (
 	SINGLE_GATHER_NUM = 1024 * 100 // 100K
 )
 
-type LogFileRecordInfo struct {
-	Data map[string]int `json:"data"` // {"data":{"file1":10,"file2":2,"file3":3}} key:文件名 value:读取的位置
-	sync.Mutex
-}
-
-var gRecordInfo LogFileRecordInfo
-var gRecordFP *os.File
 var gBufPool = utils.NewBufferPool()
+var gReadBufPool = sync.Pool{New: func() interface{} {
+	return make([]byte, SINGLE_GATHER_NUM)
+}}
 
-func RunLogClient() {
+func RunLogClient(cfg *ClientConfig) {
 	var err error
 
-	tick := time.NewTicker(time.Second * 10)
+	if err = initInputs(cfg); nil != err {
+		clog.Logger.Error("init inputs err: %v", err)
+		return
+	}
 
-	gRecordFP, err = os.OpenFile("./log_record_info.json", os.O_RDWR|os.O_CREATE, 0644)
-	defer gRecordFP.Close()
-	if nil != err {
-		clog.Logger.Error("open file err: %v", err)
+	if gCheckpoint, err = newCheckpointStore(cfg.Checkpoint); nil != err {
+		clog.Logger.Error("open checkpoint err: %v", err)
 		return
 	}
-	buf, err := ioutil.ReadAll(gRecordFP)
-	if len(buf) <= 0 {
-		gRecordInfo.Data = make(map[string]int, 1)
-	} else {
-		// decoder := json.NewDecoder(gRecordFP)
-		// err = decoder.Decode(&gRecordInfo)
-		fmt.Println("buf: ", string(buf))
-		json.Unmarshal(buf, &gRecordInfo)
-		if nil != err {
-			clog.Logger.Error("decode json err: %v", err)
+	defer gCheckpoint.Close()
+	if err = initAgent(cfg.Agent, gCheckpoint); nil != err {
+		clog.Logger.Error("init agent err: %v", err)
+		return
+	}
+	if err = loadRecordInfo(); nil != err {
+		clog.Logger.Error("decode json err: %v", err)
+		return
+	}
+
+	if gReporter, err = newReportClient(cfg.Delivery); nil != err {
+		clog.Logger.Error("init report client err: %v", err)
+		return
+	}
+	if err = gThrottle.Start(cfg.Bandwidth, cfg.Delivery); nil != err {
+		clog.Logger.Error("init bandwidth err: %v", err)
+		return
+	}
+	gScheduler = newGatherScheduler(cfg.Scheduler)
+	startMetrics(cfg.Metrics)
+	startHeartbeat(cfg)
+	if !cfg.Spool.Disable {
+		if cfg.Spool.Dir == "" {
+			cfg.Spool.Dir = filepath.Join(cfg.Checkpoint.Dir(), SPOOL_DIR_NAME)
+		}
+		if gSpool, err = newDiskSpool(cfg.Spool); nil != err {
+			clog.Logger.Error("open spool err: %v", err)
 			return
 		}
-		fmt.Println("gRecordInfo: ", gRecordInfo)
+		go gSpool.Replay()
 	}
+
+	watch_mode := cfg.WatchMode
+	if watch_mode == "" {
+		watch_mode = config.Config.External["LogWatchMode"]
+	}
+	watcher, err := NewFileWatcher(watch_mode, DEFAULT_POLL_INTERVAL)
+	if nil != err {
+		clog.Logger.Error("create file watcher err: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	// 事件驱动为主, 各输入定时全量扫描兜底(事件丢失/队列溢出/新建的子目录)
+	// 各输入同时扫描, 积压的数据由调度器按优先级采集
+	scan_ch := make(chan *gatherInput, len(gInputs))
+	var wg sync.WaitGroup
+	for _, in := range gInputs {
+		wg.Add(1)
+		go func(in *gatherInput) {
+			defer wg.Done()
+			gatherInputLog(in, watcher)
+		}(in)
+		go in.scheduleScan(scan_ch)
+	}
+	wg.Wait()
+	dropLegacyOffsets()
 	for {
 		select {
-		case <-tick.C:
-			gatherDirLog()
+		case ev := <-watcher.Events():
+			handleFileEvent(ev, watcher)
+		case err = <-watcher.Errors():
+			clog.Logger.Error("watch dir err: %v", err)
+			if err == ErrWatchOverflow || err == ErrWatchFallback {
+				for _, in := range gInputs {
+					go gatherInputLog(in, watcher)
+				}
+			}
+		case in := <-scan_ch:
+			go gatherInputLog(in, watcher)
 		}
 	}
 }
 
-func gatherDirLog() {
-	var err error
-	var out []byte
-	var file_name string // file base name
-	var file_list []string
-	var wg sync.WaitGroup
+func handleFileEvent(ev FileEvent, watcher FileWatcher) {
+	if ev.IsDir {
+		// 新建的子目录需要加入监听并扫描里面已有的文件
+		if ev.Op == FileCreate {
+			for _, in := range gInputs {
+				if in.ContainsDir(ev.Name) {
+					go gatherInputLog(in, watcher)
+				}
+			}
+		}
+		return
+	}
+
+	switch ev.Op {
+	case FileCreate, FileWrite:
+		in := matchInput(ev.Name)
+		if in == nil {
+			return
+		}
+		name, _, err := openTail(in, ev.Name, in.RelName(ev.Name))
+		if nil != err {
+			clog.Logger.Debug("open file: %s err: %v", ev.Name, err)
+			return
+		}
+		startGather(in, name, nil)
+	case FileRename, FileRemove:
+		for _, st := range markRotatedPath(ev.Name) {
+			if in := inputByName(st.input); in != nil {
+				startGather(in, st.name, nil)
+			}
+		}
+	}
+}
 
-	cmd := fmt.Sprintf("lsof +d %s |grep REG |awk '{print $9}'", config.Config.External["LogGatherDir"])
-	out, err = exec.Command("/bin/sh", "-c", cmd).Output()
-	if err != nil {
-		clog.Logger.Error("lsof err: %v", err)
+func gatherInputLog(in *gatherInput, watcher FileWatcher) {
+	if !in.tryStartScan() {
 		return
 	}
-	file_list = strings.Split(string(out), "\n")
-	fmt.Println("file_list: ", file_list)
-	for i := range file_list {
-		if file_list[i] <= "" {
+	defer in.finishScan()
+
+	var wg sync.WaitGroup
+	file_list := in.Scan(watcher)
+	names := make(map[string]bool, len(file_list))
+	seen := make(map[string]bool, len(file_list))
+	for _, path := range file_list {
+		// 文件可能同时匹配多个输入, 只归属第一个
+		if matchInput(path) != in {
 			continue
 		}
-		file_names := strings.Split(file_list[i], "/")
-		if len(file_names) >= 2 {
-			file_name = file_names[len(file_names)-1]
-		} else {
-			file_name = file_list[i]
+		name, key, err := openTail(in, path, in.RelName(path))
+		if err == errTailDrained {
+			seen[key] = true
+			continue
 		}
-		fmt.Println("file_name: ", file_name)
-		wg.Add(1)
-		if stpos, ok := gRecordInfo.Data[file_name]; ok {
-			go gatherSingleLog(file_name, stpos, &wg)
-		} else {
-			go gatherSingleLog(file_name, 0, &wg)
+		if nil != err {
+			clog.Logger.Error("open file: %s err: %v", path, err)
+			continue
 		}
+		names[name] = true
+		seen[key] = true
+	}
+	for _, name := range markUnseenTails(in.Name, seen) {
+		names[name] = true
+	}
+	for name := range names {
+		startGather(in, name, &wg)
 	}
 	wg.Wait()
 
-	gRecordFP.Truncate(0)
-	buf, err := json.Marshal(&gRecordInfo)
-	gRecordFP.Write(buf)
+	saveRecordInfo()
 }
 
-// file_name: 文件名
-// stpos: 起始的读取位置
-func gatherSingleLog(file_name string, stpos int, wg *sync.WaitGroup) {
-	defer wg.Done()
-	var rbuf []byte = make([]byte, SINGLE_GATHER_NUM)
+type gatherState struct {
+	running bool   // 正在采集或排队
+	pending bool   // 采集过程中又有新的写入, 结束后需要再采集一次
+	round   uint64 // 上次采集结束时的轮次
+}
 
-	fp, err := os.OpenFile(config.Config.External["LogGatherDir"]+file_name, os.O_RDONLY, 0644)
-	defer fp.Close()
-	if nil != err {
-		clog.Logger.Error("open file err: %v", err)
-		return
+// 采集流, 同一个输入下上报名相同的文件(包括轮转出去的)属于同一个流
+type streamKey struct {
+	input string
+	name  string
+}
+
+var gGathering = struct {
+	sync.Mutex
+	files map[streamKey]*gatherState
+}{files: make(map[streamKey]*gatherState, 1)}
+
+// 同一个上报文件名同时只在一个采集协程中, 轮转出去的旧文件先于新文件采集
+// wg不为nil时第一轮采集完就Done, 由扫描统一保存记录; 为nil时每轮采集完由采集协程保存
+func startGather(in *gatherInput, file_name string, wg *sync.WaitGroup) {
+	stream := streamKey{input: in.Name, name: file_name}
+	gGathering.Lock()
+	st, ok := gGathering.files[stream]
+	if !ok {
+		st = &gatherState{}
+		gGathering.files[stream] = st
 	}
-	rn, err := fp.ReadAt(rbuf, int64(stpos))
-	if nil != err {
-		clog.Logger.Error("read from file: %s err: %v", config.Config.External["LogGatherDir"]+file_name, err)
+	if st.running {
+		st.pending = true
+		gGathering.Unlock()
 		return
 	}
-	// 丢弃最后被截断的一行，放到下次读取
-	if rbuf[len(rbuf)-1] != 10 {
-		lastRetPos := utils.GetLastReturnPos(rbuf)
-		if lastRetPos > 0 {
-			rn = lastRetPos + 1
-			rbuf = rbuf[:rn]
+	st.running = true
+	gGathering.Unlock()
+
+	if wg != nil {
+		wg.Add(1)
+	}
+	gScheduler.Submit(in, stream, st, wg)
+}
+
+// 依次采集一个采集流的所有文件, 最多发送quantum块, 还有数据没有读完时返回true
+func runGather(in *gatherInput, file_name string, quantum int) bool {
+	budget := quantum
+	for _, t := range tailsByName(in.Name, file_name) {
+		if gatherTail(in, t, &budget) {
+			return true
 		}
 	}
+	return false
+}
+
+// 一直读到文件末尾, 积压的数据按SINGLE_GATHER_NUM分块连续发送, 追上后再等待新的写入事件
+// 发送的块数用完budget后返回true, 由调度器安排下次继续
+func gatherTail(in *gatherInput, t *tailFile, budget *int) bool {
+	for {
+		name, uid, stpos, size, done, err := prepareTail(t)
+		if nil != err {
+			clog.Logger.Error("check file: %s err: %v", t.key, err)
+			return false
+		}
+		if done {
+			clog.Logger.Info("rotated file: %s drained, close it", name)
+			closeTail(t)
+			return false
+		}
+		if stpos >= size {
+			atomic.StoreInt64(&t.backlog, 0)
+			return false
+		}
+		atomic.StoreInt64(&t.backlog, size-stpos)
+
+		// 文件一段时间没有增长, 留在末尾的多行事件可以发送了
+		idle := time.Since(t.lastGrow)
+		flush := idle >= in.splitter.FlushTimeout()
+		next, ok := gatherSingleLog(t.fp, in, name, uid, stpos, size, flush)
+		if !ok {
+			return false
+		}
+		if next != stpos {
+			commitTail(t, next)
+			*budget--
+			if *budget <= 0 {
+				return true
+			}
+			continue
+		}
+
+		// 末尾只剩不完整的行或事件, 多行事件到时间后再采集一次
+		if !flush && atomic.CompareAndSwapInt32(&t.flushTimer, 0, 1) {
+			time.AfterFunc(in.splitter.FlushTimeout()-idle, func() {
+				atomic.StoreInt32(&t.flushTimer, 0)
+				startGather(in, name, nil)
+			})
+		}
+		return false
+	}
+}
+
+// fp: 已打开的文件
+// in: 所属输入, 决定上报地址和事件切分规则
+// file_name: 上报使用的文件名
+// file_id: 文件实例的标识, 服务端按它和位置去重
+// stpos: 起始的读取位置
+// size: 文件当前大小
+// flush: 文件已经不再增长, 末尾的多行事件视为完整
+// 返回下次读取的位置, 和服务端已确认的位置对不上时为服务端的位置
+func gatherSingleLog(fp *os.File, in *gatherInput, file_name, file_id string, stpos, size int64, flush bool) (int64, bool) {
+	rbuf := gReadBufPool.Get().([]byte)
+	defer gReadBufPool.Put(rbuf)
+
+	// 剩余数据不足一块时ReadAt返回io.EOF, 读到的部分照常发送
+	rn, err := fp.ReadAt(rbuf, stpos)
+	if nil != err && err != io.EOF {
+		clog.Logger.Error("read from file: %s err: %v", fp.Name(), err)
+		gReadErrorCount.Inc(1)
+		return stpos, false
+	}
+	// 最后被截断的一行或者不完整的多行事件放到下次读取
+	rn = in.splitter.Cut(rbuf[:rn], rn == len(rbuf), flush && stpos+int64(rn) >= size)
+	if rn == 0 {
+		return stpos, true
+	}
+	rbuf = rbuf[:rn]
+	gReadBytesCount.Inc(int64(rn))
+
+	// 过滤后没有剩下的事件也照常上报, 服务端的进度需要连续
+	data := rbuf
+	if in.filter != nil || in.redactor != nil || in.limiter != nil {
+		var pbuf *bytes.Buffer = gBufPool.Get()
+		defer gBufPool.Put(pbuf)
+		if pbuf == nil {
+			err = errcode.NewInternalError(errcode.InternalErrorCode, err)
+			clog.Logger.Error("get memory from buf pool err: %v", err)
+			return stpos, false
+		}
+		in.process(pbuf, rbuf, file_name, size-stpos)
+		data = pbuf.Bytes()
+	}
 
 	var wbuf *bytes.Buffer = gBufPool.Get()
 	defer gBufPool.Put(wbuf)
 	if wbuf == nil {
 		err = errcode.NewInternalError(errcode.InternalErrorCode, err)
 		clog.Logger.Error("get memory from buf pool err: %v", err)
-		return
+		return stpos, false
 	}
-	gWriter, err := gzip.NewWriterLevel(wbuf, gzip.BestCompression)
-	defer gWriter.Close()
-	_, err = gWriter.Write(rbuf)
-	err = gWriter.Flush()
-	if nil != err {
-		clog.Logger.Error("gzip compress data err: %v", err)
-		return
+	if err = in.codec.Encode(wbuf, data); nil != err {
+		clog.Logger.Error("%s compress data err: %v", in.codec.Name(), err)
+		return stpos, false
 	}
 
 	body := protocol.LogGatherReport{
-		FileName:    file_name,
-		LogInfoGzip: wbuf.Bytes(),
-	}
-	b, err := json.Marshal(&body)
-	req, err := http.NewRequest("POST", config.Config.External["LogReportUrl"], ioutil.NopCloser(strings.NewReader(string(b))))
-	rsp, err := http.DefaultClient.Do(req)
-	if nil != err || rsp.StatusCode != http.StatusOK {
-		clog.Logger.Error("post http to report log err: %v, rsp: %v", err, rsp)
-		return
+		Agent:    gAgent,
+		FileName: file_name,
+		FileId:   file_id,
+		Codec:    in.codec.Name(),
+		Offset:   stpos,
+		End:      stpos + int64(rn),
+		LogInfo:  wbuf.Bytes(),
+	}
+	body.ChecksumAlgo, body.Checksum = gReporter.checksum(data)
+	// 采集进度只推进到服务端确认写入的位置
+	if gSpool == nil {
+		committed, err := gReporter.Deliver(in.ReportUrl, &body)
+		if nil != err {
+			if conflict, ok := err.(*offsetConflictError); ok {
+				return conflictOffset(file_name, stpos, conflict), true
+			}
+			clog.Logger.Error("post http to report log err: %v", err)
+			return stpos, false
+		}
+		return committed, true
 	}
 
-	gRecordInfo.Lock()
-	if gRecordInfo.Data == nil {
-		gRecordInfo.Data = make(map[string]int, 1)
+	// 落盘的数据还没发完时新数据排在后面, 保证同一个文件按顺序上报
+	// 落盘后视为已确认, 由重放保证送达
+	if !gSpool.Pending() {
+		committed, err := gReporter.Deliver(in.ReportUrl, &body)
+		if nil == err {
+			return committed, true
+		}
+		if conflict, ok := err.(*offsetConflictError); ok {
+			return conflictOffset(file_name, stpos, conflict), true
+		}
+		clog.Logger.Error("post http to report log err: %v, spool it", err)
 	}
-	gRecordInfo.Data[file_name] = stpos + rn
-	gRecordInfo.Unlock()
+	if err = gSpool.Append(&spoolBatch{Url: in.ReportUrl, Time: time.Now().Unix(), Report: body}); nil != err {
+		clog.Logger.Error("spool file: %s err: %v", file_name, err)
+		return stpos, false
+	}
+	return body.End, true
+}
+
+// 按事件过滤, 限速和脱敏, 发送的事件按原顺序写入dst, 数据在这之后才压缩和计算校验和
+// lag为这一块开始时文件还没读的字节数
+func (in *gatherInput) process(dst *bytes.Buffer, src []byte, file_name string, lag int64) {
+	var lim *streamLimiter
+	var catchup bool
+	if in.limiter != nil {
+		lim = in.limiter.Stream(file_name)
+		catchup = in.limiter.Catchup(lag)
+		defer in.limiter.Mark(lim, dst)
+	}
+	in.splitter.Each(src, func(event []byte) {
+		if in.filter != nil && !in.filter.Keep(event) {
+			return
+		}
+		if lim != nil && !in.limiter.Admit(lim, dst, event, catchup) {
+			return
+		}
+		if in.redactor != nil {
+			if event = in.redactor.Redact(event); event == nil {
+				return
+			}
+		}
+		dst.Write(event)
+	})
+}
+
+// 服务端已确认的位置在前面时回退重读(服务端丢了数据), 在后面时跳过已写入的部分
+// 位置超出文件大小时下次采集会按截断处理, 换一个文件实例从头开始
+func conflictOffset(file_name string, stpos int64, conflict *offsetConflictError) int64 {
+	clog.Logger.Warning("report file: %s at %d, continue from server committed %d: %s",
+		file_name, stpos, conflict.committed, conflict.msg)
+	return conflict.committed
 }
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"backend/common/clog"
+	"github.com/zh4af/loggather/protocol"
+)
+
+const (
+	DEFAULT_HEARTBEAT_INTERVAL = 30 // 秒
+	CONFIG_HASH_LEN            = 16
+)
+
+// 启动时立即发一次, 之后按间隔发给所有上报的服务端
+func startHeartbeat(cfg *ClientConfig) {
+	interval := cfg.Agent.Heartbeat
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	hb := &protocol.Heartbeat{
+		Agent:      gAgent,
+		ConfigHash: configHash(cfg),
+		StartTime:  time.Now().Unix(),
+		Interval:   interval,
+	}
+	go func() {
+		tick := time.NewTicker(time.Duration(interval) * time.Second)
+		defer tick.Stop()
+		for {
+			sendHeartbeat(hb)
+			<-tick.C
+		}
+	}()
+}
+
+// 客户端配置JSON的sha1, 同一份配置在各台机器上相同
+func configHash(cfg *ClientConfig) string {
+	buf, err := json.Marshal(cfg)
+	if nil != err {
+		return ""
+	}
+	sum := sha1.Sum(buf)
+	return hex.EncodeToString(sum[:])[:CONFIG_HASH_LEN]
+}
+
+func sendHeartbeat(hb *protocol.Heartbeat) {
+	hb.Files = hb.Files[:0]
+	hb.Lag = 0
+	for stream, lag := range streamLags() {
+		hb.Files = append(hb.Files, protocol.HeartbeatFile{Input: stream.input, Name: stream.name, Lag: lag})
+		hb.Lag += lag
+	}
+	sort.Slice(hb.Files, func(i, j int) bool {
+		if hb.Files[i].Input != hb.Files[j].Input {
+			return hb.Files[i].Input < hb.Files[j].Input
+		}
+		return hb.Files[i].Name < hb.Files[j].Name
+	})
+
+	for _, target_url := range heartbeatTargets() {
+		if err := gReporter.Heartbeat(target_url, hb); nil != err {
+			clog.Logger.Warning("heartbeat to %s err: %v", target_url, err)
+		}
+	}
+}
+
+// 各输入的上报地址按服务端列表展开后换成心跳路径, 每台服务端都发一次, 各自都有完整的客户端列表
+func heartbeatTargets() []string {
+	var targets []string
+	seen := make(map[string]bool, 1)
+	for _, in := range gInputs {
+		for _, report_url := range gReporter.pool.Candidates(in.ReportUrl, "") {
+			u, err := url.Parse(report_url)
+			if nil != err {
+				continue
+			}
+			u.Path = protocol.HeartbeatPath(u.Path)
+			if target_url := u.String(); !seen[target_url] {
+				seen[target_url] = true
+				targets = append(targets, target_url)
+			}
+		}
+	}
+	return targets
+}
+
+// Heartbeat 不经过熔断器, 心跳失败不影响上报
+func (c *reportClient) Heartbeat(target_url string, hb *protocol.Heartbeat) error {
+	if c.stream != nil {
+		u, err := url.Parse(target_url)
+		if nil != err {
+			return err
+		}
+		return c.stream.Heartbeat(u.Host, hb)
+	}
+
+	buf, err := json.Marshal(hb)
+	if nil != err {
+		return err
+	}
+	req, err := http.NewRequest("POST", target_url, bytes.NewReader(buf))
+	if nil != err {
+		return err
+	}
+	req.Header.Set("Content-Type", protocol.CONTENT_TYPE_JSON)
+	rsp, err := c.client.Do(req)
+	if nil != err {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("heartbeat http status: %d", rsp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"backend/common/clog"
+	"backend/common/config"
+	"github.com/zh4af/loggather/protocol"
+)
+
+const (
+	DEFAULT_INPUT_NAME    = "default"
+	DEFAULT_SCAN_INTERVAL = 10 // 秒
+)
+
+// InputConfig 一组采集文件
+type InputConfig struct {
+	Name         string           // 输入名称, 用于区分采集记录
+	Paths        []string         // 采集文件的glob, 支持用**匹配任意层目录, 如 /var/log/lwork/**/*.log
+	Excludes     []string         // 排除的glob, 不含/时只匹配文件名, 如 *.mysql
+	ScanInterval int              // 全量扫描间隔(秒), 默认10秒
+	ReportUrl    string           // 上报地址
+	Multiline    *MultilineConfig // 多行事件合并规则, 不配置时按行切分
+	Codec        string           // 压缩方式 gzip(默认)/snappy/lz4, snappy和lz4需要服务端也已升级
+	CodecLevel   int              // gzip压缩级别1-9, 默认6
+	Filter       *FilterConfig    // 发送前按事件过滤, 不配置时全部发送
+	Redact       *RedactConfig    // 发送前脱敏, 在过滤之后
+	Limit        *LimitConfig     // 每个文件的限速和采样, 在过滤之后, 脱敏之前
+	Priority     int              // 采集优先级, 默认0; 都有积压时每高一级分到的采集量多一倍, 低的不会一直等
+}
+
+type ClientConfig struct {
+	WatchMode  string // auto/inotify/poll
+	Inputs     []InputConfig
+	Spool      SpoolConfig
+	Checkpoint CheckpointConfig
+	Delivery   DeliveryConfig
+	Agent      AgentConfig
+	Bandwidth  BandwidthConfig
+	Scheduler  SchedulerConfig
+	Metrics    MetricsConfig
+}
+
+type gatherInput struct {
+	InputConfig
+	scanInterval time.Duration
+	splitter     *eventSplitter
+	filter       *eventFilter
+	redactor     *redactor
+	limiter      *inputLimiter
+	codec        protocol.Codec
+	scanning     int32
+}
+
+var gInputs []*gatherInput
+
+// 没有配置Inputs时按旧的External配置生成一个输入
+func legacyInputConfig() InputConfig {
+	dir := config.Config.External["LogGatherDir"]
+	return InputConfig{
+		Name:      DEFAULT_INPUT_NAME,
+		Paths:     []string{filepath.Join(dir, "**", "*")},
+		ReportUrl: config.Config.External["LogReportUrl"],
+	}
+}
+
+func initInputs(cfg *ClientConfig) error {
+	inputs := cfg.Inputs
+	if len(inputs) == 0 {
+		inputs = []InputConfig{legacyInputConfig()}
+	}
+
+	names := make(map[string]bool, len(inputs))
+	gInputs = make([]*gatherInput, 0, len(inputs))
+	for i := range inputs {
+		in := &gatherInput{InputConfig: inputs[i]}
+		if in.Name == "" {
+			in.Name = fmt.Sprintf("input%d", i)
+		}
+		if names[in.Name] {
+			return errors.New("duplicate input name: " + in.Name)
+		}
+		names[in.Name] = true
+		if len(in.Paths) == 0 {
+			return errors.New("input " + in.Name + " has no paths")
+		}
+		for _, patterns := range [][]string{in.Paths, in.Excludes} {
+			for _, pattern := range patterns {
+				if _, err := filepath.Match(pattern, ""); nil != err {
+					return fmt.Errorf("input %s bad pattern %s: %v", in.Name, pattern, err)
+				}
+			}
+		}
+		if in.ReportUrl == "" {
+			in.ReportUrl = config.Config.External["LogReportUrl"]
+		}
+		splitter, err := newEventSplitter(in.Multiline)
+		if nil != err {
+			return fmt.Errorf("input %s bad multiline config: %v", in.Name, err)
+		}
+		in.splitter = splitter
+		if in.filter, err = newEventFilter(in.Name, in.Filter); nil != err {
+			return fmt.Errorf("input %s bad filter config: %v", in.Name, err)
+		}
+		if in.redactor, err = newRedactor(in.Name, in.Redact); nil != err {
+			return fmt.Errorf("input %s bad redact config: %v", in.Name, err)
+		}
+		if in.limiter, err = newInputLimiter(in.Name, in.Limit); nil != err {
+			return fmt.Errorf("input %s bad limit config: %v", in.Name, err)
+		}
+		if in.codec, err = protocol.NewCodec(in.Codec, in.CodecLevel); nil != err {
+			return fmt.Errorf("input %s bad codec %s: %v", in.Name, in.Codec, err)
+		}
+		in.scanInterval = time.Duration(in.ScanInterval) * time.Second
+		if in.scanInterval <= 0 {
+			in.scanInterval = DEFAULT_SCAN_INTERVAL * time.Second
+		}
+		gInputs = append(gInputs, in)
+	}
+
+	return nil
+}
+
+func inputByName(name string) *gatherInput {
+	for _, in := range gInputs {
+		if in.Name == name {
+			return in
+		}
+	}
+	return nil
+}
+
+// 文件归属于第一个匹配的输入
+func matchInput(path string) *gatherInput {
+	for _, in := range gInputs {
+		if in.Match(path) {
+			return in
+		}
+	}
+	return nil
+}
+
+func (in *gatherInput) Match(path string) bool {
+	if in.excluded(path) {
+		return false
+	}
+	for _, pattern := range in.Paths {
+		if matchGlob(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (in *gatherInput) excluded(path string) bool {
+	for _, pattern := range in.Excludes {
+		if strings.Contains(pattern, "/") {
+			if matchGlob(pattern, path) {
+				return true
+			}
+		} else if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 扫描所有匹配的文件, 经过的目录都加入监听
+func (in *gatherInput) Scan(watcher FileWatcher) []string {
+	var file_list []string
+	seen := make(map[string]bool, 1)
+
+	for _, pattern := range in.Paths {
+		root, rest := globRoot(pattern)
+
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if nil != err {
+				clog.Logger.Warning("input %s walk %s err: %v", in.Name, path, err)
+				return nil
+			}
+			if info.IsDir() {
+				if path != root && in.excluded(path) {
+					return filepath.SkipDir
+				}
+				// 只进入和glob对应层匹配的目录, **之下的任意层都进入
+				if path != root && !matchGlobDir(rest, relSegments(root, path)) {
+					return filepath.SkipDir
+				}
+				if err := watcher.Add(path); nil != err {
+					clog.Logger.Warning("input %s watch dir %s err: %v", in.Name, path, err)
+				}
+				return nil
+			}
+			if seen[path] || !in.Match(path) {
+				return nil
+			}
+			seen[path] = true
+			file_list = append(file_list, path)
+			return nil
+		})
+	}
+
+	return file_list
+}
+
+// 上报使用的文件名: 相对于匹配的glob根目录的路径, 如 /var/log/lwork/**/*.log 下的 a/app.log
+func (in *gatherInput) RelName(path string) string {
+	for _, pattern := range in.Paths {
+		if !matchGlob(pattern, path) {
+			continue
+		}
+		root, _ := globRoot(pattern)
+		if rel, err := filepath.Rel(root, path); nil == err && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.Base(path)
+}
+
+// 目录下是否可能有输入要采集的文件, 按和Scan相同的规则判断, 新建这样的目录需要马上扫描
+func (in *gatherInput) ContainsDir(dir string) bool {
+	if in.excluded(dir) {
+		return false
+	}
+	for _, pattern := range in.Paths {
+		root, rest := globRoot(pattern)
+		if segs := relSegments(root, dir); len(segs) > 0 && matchGlobDir(rest, segs) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按扫描间隔通知主循环全量扫描
+func (in *gatherInput) scheduleScan(scan_ch chan<- *gatherInput) {
+	tick := time.NewTicker(in.scanInterval)
+	defer tick.Stop()
+	for range tick.C {
+		scan_ch <- in
+	}
+}
+
+// glob中第一个含通配符的段之前的部分作为扫描的根目录
+func globRoot(pattern string) (string, []string) {
+	segs := strings.Split(filepath.ToSlash(filepath.Clean(pattern)), "/")
+	for i, seg := range segs {
+		if strings.ContainsAny(seg, "*?[") {
+			root := strings.Join(segs[:i], "/")
+			if root == "" {
+				root = "/"
+			}
+			return filepath.FromSlash(root), segs[i:]
+		}
+	}
+	return filepath.Dir(pattern), []string{filepath.Base(pattern)}
+}
+
+// path相对root的各段, 不在root下面或就是root时为nil
+func relSegments(root, path string) []string {
+	rel, err := filepath.Rel(root, path)
+	if nil != err || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	return strings.Split(filepath.ToSlash(rel), "/")
+}
+
+// 相对glob根目录各段为segs的目录下是否可能有匹配的文件, rest为globRoot返回的glob部分
+// 最后一段是文件名, 目录只能对应前面的段; 遇到**后任意层都可能匹配
+func matchGlobDir(rest, segs []string) bool {
+	for i, seg := range segs {
+		if i >= len(rest) {
+			return false
+		}
+		if rest[i] == "**" {
+			return true
+		}
+		if i == len(rest)-1 {
+			return false
+		}
+		if ok, _ := filepath.Match(rest[i], seg); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// 按/分段匹配, **匹配任意层(包括0层)目录
+func matchGlob(pattern, path string) bool {
+	pat := strings.Split(filepath.ToSlash(filepath.Clean(pattern)), "/")
+	segs := strings.Split(filepath.ToSlash(filepath.Clean(path)), "/")
+	return matchSegments(pat, segs)
+}
+
+func matchSegments(pat, segs []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			pat = pat[1:]
+			if len(pat) == 0 {
+				return true
+			}
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pat, segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// 同一个输入同时只有一次全量扫描
+func (in *gatherInput) tryStartScan() bool {
+	return atomic.CompareAndSwapInt32(&in.scanning, 0, 1)
+}
+
+func (in *gatherInput) finishScan() {
+	atomic.StoreInt32(&in.scanning, 0)
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/var/log/*.log", "/var/log/app.log", true},
+		{"/var/log/*.log", "/var/log/a/app.log", false},
+		{"/var/log/*.log", "/var/log/app.txt", false},
+		// **匹配零层目录
+		{"/var/log/**/*.log", "/var/log/app.log", true},
+		{"/var/log/**/*.log", "/var/log/a/app.log", true},
+		{"/var/log/**/*.log", "/var/log/a/b/c/app.log", true},
+		{"/var/log/**/*.log", "/var/other/app.log", false},
+		{"/var/log/**", "/var/log/a/b", true},
+		{"/var/log/**/b/*.log", "/var/log/b/app.log", true},
+		{"/var/log/**/b/*.log", "/var/log/a/b/app.log", true},
+		{"/var/log/**/b/*.log", "/var/log/a/c/app.log", false},
+		{"/var/log/*/*.log", "/var/log/a/app.log", true},
+		{"/var/log/*/*.log", "/var/log/app.log", false},
+		{"/var/log/app-?.log", "/var/log/app-1.log", true},
+		{"/var/log/app-[0-9].log", "/var/log/app-x.log", false},
+		{"/var/log//a/../*.log", "/var/log/app.log", true},
+		{"/*.log", "/app.log", true},
+		{"/*.log", "/var/app.log", false},
+	}
+	for _, c := range cases {
+		if got := matchGlob(c.pattern, c.path); got != c.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	cases := []struct {
+		pat  []string
+		segs []string
+		want bool
+	}{
+		{[]string{"**"}, []string{}, true},
+		{[]string{"**", "*.log"}, []string{"a.log"}, true},
+		{[]string{"**", "**", "*.log"}, []string{"a.log"}, true},
+		{[]string{"a", "**"}, []string{"a"}, true},
+		{[]string{"a", "**", "b"}, []string{"a", "b"}, true},
+		{[]string{"a", "**", "b"}, []string{"a", "x", "y", "b"}, true},
+		{[]string{"a", "**", "b"}, []string{"a", "x", "y"}, false},
+		{[]string{"a"}, []string{}, false},
+		{[]string{}, []string{"a"}, false},
+	}
+	for _, c := range cases {
+		if got := matchSegments(c.pat, c.segs); got != c.want {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", c.pat, c.segs, got, c.want)
+		}
+	}
+}
+
+func TestGlobRoot(t *testing.T) {
+	cases := []struct {
+		pattern string
+		root    string
+		rest    []string
+	}{
+		{"/var/log/*.log", "/var/log", []string{"*.log"}},
+		{"/var/log/**/*.log", "/var/log", []string{"**", "*.log"}},
+		{"/var/log/app-?/x.log", "/var/log", []string{"app-?", "x.log"}},
+		{"/var/log/[ab]/x.log", "/var/log", []string{"[ab]", "x.log"}},
+		{"/*.log", "/", []string{"*.log"}},
+		{"/var/log/app.log", "/var/log", []string{"app.log"}},
+		{"/var/log/./a/../*.log", "/var/log", []string{"*.log"}},
+	}
+	for _, c := range cases {
+		root, rest := globRoot(c.pattern)
+		if root != c.root || !reflect.DeepEqual(rest, c.rest) {
+			t.Errorf("globRoot(%q) = %q, %q, want %q, %q", c.pattern, root, rest, c.root, c.rest)
+		}
+	}
+}
+
+func TestInputMatch(t *testing.T) {
+	in := &gatherInput{InputConfig: InputConfig{
+		Paths:    []string{"/var/log/**/*.log"},
+		Excludes: []string{"*.mysql.log", "/var/log/tmp/**"},
+	}}
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"/var/log/app.log", true},
+		{"/var/log/a/app.log", true},
+		// 不含/的排除只匹配文件名, 任意目录下都生效
+		{"/var/log/app.mysql.log", false},
+		{"/var/log/a/b/app.mysql.log", false},
+		// 含/的排除匹配完整路径
+		{"/var/log/tmp/app.log", false},
+		{"/var/log/tmp/a/app.log", false},
+		{"/var/log/a/tmp/app.log", true},
+		{"/var/log/app.txt", false},
+	}
+	for _, c := range cases {
+		if got := in.Match(c.path); got != c.want {
+			t.Errorf("Match(%q) = %v, want %v", c.path, got, c.want)
+		}
+	}
+}
+
+func TestRelName(t *testing.T) {
+	in := &gatherInput{InputConfig: InputConfig{
+		Paths: []string{"/var/log/app/*.log", "/var/log/**/*.log", "/*.txt"},
+	}}
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/var/log/app/a.log", "a.log"},
+		{"/var/log/a.log", "a.log"},
+		{"/var/log/x/y/a.log", "x/y/a.log"},
+		{"/a.txt", "a.txt"},
+		// 没有匹配的glob时只用文件名
+		{"/data/a.dat", "a.dat"},
+	}
+	for _, c := range cases {
+		if got := in.RelName(c.path); got != c.want {
+			t.Errorf("RelName(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
+
+func TestContainsDir(t *testing.T) {
+	in := &gatherInput{InputConfig: InputConfig{
+		Paths:    []string{"/var/log/*/app/*.log", "/data/**/*.log", "/srv/*.log"},
+		Excludes: []string{"/data/tmp/**"},
+	}}
+	cases := []struct {
+		dir  string
+		want bool
+	}{
+		{"/var/log/a", true},
+		{"/var/log/a/app", true},
+		// 没有**时只有和glob对应层匹配的目录
+		{"/var/log/a/web", false},
+		{"/var/log/a/app/b", false},
+		{"/data/a", true},
+		{"/data/a/b/c", true},
+		{"/data/tmp/a", false},
+		// 只有文件名一段glob时没有子目录要扫描
+		{"/srv/a", false},
+		{"/var/log", false},
+		{"/other/a", false},
+	}
+	for _, c := range cases {
+		if got := in.ContainsDir(c.dir); got != c.want {
+			t.Errorf("ContainsDir(%q) = %v, want %v", c.dir, got, c.want)
+		}
+	}
+}
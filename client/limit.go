@@ -0,0 +1,201 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"third/go-metrics"
+)
+
+const (
+	DEFAULT_LIMIT_MARK_INTERVAL = 10  // 秒
+	LIMIT_IDLE_EXPIRE           = 600 // 秒, 文件多久没有数据后清理限速状态
+	CLOG_LEVEL_WARN             = 3
+)
+
+// LimitConfig 每个文件单独限速和采样, 按读取的速度计算
+// 重启或网络恢复后追赶积压时, 读取速度远大于当时的写入速度, 配置了CatchupLag时这期间按限速等待而不丢弃
+type LimitConfig struct {
+	LinesPerSec  int     // 每秒最多发送多少个事件, 0不限制
+	BytesPerSec  int     // 每秒最多发送多少字节(压缩前), 0不限制
+	SampleRate   float64 // 按比例随机保留事件, 0或1不采样
+	KeepWarn     bool    // WARN及以上的clog事件不受采样和限速影响
+	MarkInterval int     // 限速丢弃事件后, 最多每隔多少秒在数据中写一行提示, 默认10
+	CatchupLag   int64   // 文件未读的字节数超过多少时视为追赶积压, 放慢读取而不丢弃, 发送速度仍不超过限速; 0不区分
+}
+
+// tokenBucket 每秒补充rate个, 最多攒burst个; 允许欠账, 单个事件比burst大时也能发出, 平均速度不变
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// 调用方需持有锁
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow 有余量时扣除n个并返回true, 欠账没有还清时返回false
+func (b *tokenBucket) Allow(n float64) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(time.Now())
+	if b.tokens <= 0 {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Wait 扣除n个, 欠账时等到还清再返回, 多个协程共用时按调用顺序排队
+func (b *tokenBucket) Wait(n float64) {
+	b.Lock()
+	b.refill(time.Now())
+	b.tokens -= n
+	debt := -b.tokens
+	rate := b.rate
+	b.Unlock()
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / rate * float64(time.Second)))
+	}
+}
+
+// SetRate 修改速度, 已有的欠账不变
+func (b *tokenBucket) SetRate(rate, burst float64) {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	b.burst = burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+type inputLimiter struct {
+	cfg          LimitConfig
+	markInterval time.Duration
+
+	sync.Mutex
+	streams map[string]*streamLimiter // key: 上报文件名
+
+	suppressedCount metrics.Counter
+	sampledCount    metrics.Counter
+}
+
+// streamLimiter 一个文件的限速状态, 同一个文件同时只有一个采集协程
+type streamLimiter struct {
+	lines      *tokenBucket
+	bytes      *tokenBucket
+	suppressed int64
+	lastMark   time.Time
+	lastUse    time.Time
+}
+
+func newInputLimiter(input string, cfg *LimitConfig) (*inputLimiter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.LinesPerSec < 0 || cfg.BytesPerSec < 0 || cfg.SampleRate < 0 || cfg.SampleRate > 1 || cfg.CatchupLag < 0 {
+		return nil, errors.New("bad limit config")
+	}
+	if cfg.MarkInterval <= 0 {
+		cfg.MarkInterval = DEFAULT_LIMIT_MARK_INTERVAL
+	}
+	return &inputLimiter{
+		cfg:             *cfg,
+		markInterval:    time.Duration(cfg.MarkInterval) * time.Second,
+		streams:         make(map[string]*streamLimiter, 1),
+		suppressedCount: metrics.GetOrRegisterCounter("limit."+input+".suppressed", nil),
+		sampledCount:    metrics.GetOrRegisterCounter("limit."+input+".sampled", nil),
+	}, nil
+}
+
+func (l *inputLimiter) Stream(file_name string) *streamLimiter {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+
+	s, ok := l.streams[file_name]
+	if !ok {
+		// 按日期命名的文件不断出现, 顺便清理很久没有数据的
+		for name, old := range l.streams {
+			if now.Sub(old.lastUse) > LIMIT_IDLE_EXPIRE*time.Second {
+				delete(l.streams, name)
+			}
+		}
+		s = &streamLimiter{lastMark: now}
+		if l.cfg.LinesPerSec > 0 {
+			s.lines = newTokenBucket(float64(l.cfg.LinesPerSec), float64(l.cfg.LinesPerSec))
+		}
+		if l.cfg.BytesPerSec > 0 {
+			s.bytes = newTokenBucket(float64(l.cfg.BytesPerSec), float64(l.cfg.BytesPerSec))
+		}
+		l.streams[file_name] = s
+	}
+	s.lastUse = now
+	return s
+}
+
+// Catchup 未读的字节数lag是否算作追赶积压
+func (l *inputLimiter) Catchup(lag int64) bool {
+	return l.cfg.CatchupLag > 0 && lag > l.cfg.CatchupLag
+}
+
+// Admit 事件是否发送, 到了提示间隔时先把提示行写入dst; catchup时超出限速的事件等到有余量再发送, 不丢弃
+func (l *inputLimiter) Admit(s *streamLimiter, dst *bytes.Buffer, event []byte, catchup bool) bool {
+	l.Mark(s, dst)
+
+	if l.cfg.KeepWarn {
+		if m := clogLevelPattern.FindSubmatch(event); m != nil && clogLevels[string(m[2])] >= CLOG_LEVEL_WARN {
+			return true
+		}
+	}
+	if l.cfg.SampleRate > 0 && l.cfg.SampleRate < 1 && rand.Float64() >= l.cfg.SampleRate {
+		l.sampledCount.Inc(1)
+		return false
+	}
+	if catchup {
+		if s.lines != nil {
+			s.lines.Wait(1)
+		}
+		if s.bytes != nil {
+			s.bytes.Wait(float64(len(event)))
+		}
+		return true
+	}
+	if (s.lines != nil && !s.lines.Allow(1)) || (s.bytes != nil && !s.bytes.Allow(float64(len(event)))) {
+		s.suppressed++
+		l.suppressedCount.Inc(1)
+		return false
+	}
+	return true
+}
+
+// Mark 限速丢弃过事件时按间隔写一行提示, 文件不再写入时最后一段的提示在下次有数据时写入
+// 提示行带clog的级别前缀, 按clog规则合并多行事件时是一个独立的事件
+func (l *inputLimiter) Mark(s *streamLimiter, dst *bytes.Buffer) {
+	now := time.Now()
+	if s.suppressed == 0 || now.Sub(s.lastMark) < l.markInterval {
+		return
+	}
+	fmt.Fprintf(dst, "WARN:%s loggather: %d lines suppressed by rate limit in last %ds\n",
+		now.Format("2006-01-02 15:04:05.000"), s.suppressed, int(now.Sub(s.lastMark).Seconds()))
+	s.suppressed = 0
+	s.lastMark = now
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// 积压很多的文件默认照样限速, 超出的事件丢弃
+func TestLimitLaggingFile(t *testing.T) {
+	l, err := newInputLimiter("test", &LimitConfig{LinesPerSec: 10})
+	if nil != err {
+		t.Fatal(err)
+	}
+	s := l.Stream("app.log")
+	catchup := l.Catchup(1 << 30)
+	if catchup {
+		t.Errorf("catchup without CatchupLag")
+	}
+	var dst bytes.Buffer
+	admitted := 0
+	for i := 0; i < 100; i++ {
+		if l.Admit(s, &dst, []byte("line\n"), catchup) {
+			admitted++
+		}
+	}
+	if admitted > 11 {
+		t.Errorf("admitted %d of 100 lines, want at most 11", admitted)
+	}
+}
+
+// 配置了CatchupLag时追赶积压的事件不丢弃, 但发送速度仍不超过限速
+func TestLimitCatchupWaits(t *testing.T) {
+	l, err := newInputLimiter("test", &LimitConfig{LinesPerSec: 100, CatchupLag: 1 << 20})
+	if nil != err {
+		t.Fatal(err)
+	}
+	s := l.Stream("app.log")
+	if l.Catchup(1 << 10) {
+		t.Errorf("catchup under CatchupLag")
+	}
+	if !l.Catchup(1 << 30) {
+		t.Fatalf("no catchup over CatchupLag")
+	}
+	var dst bytes.Buffer
+	start := time.Now()
+	for i := 0; i < 120; i++ {
+		if !l.Admit(s, &dst, []byte("line\n"), true) {
+			t.Fatalf("line %d dropped while catching up", i)
+		}
+	}
+	// 前100行用掉初始余量, 后20行按每秒100行至少要等200ms
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("120 lines admitted in %v, want rate limited", elapsed)
+	}
+}
+
+func TestNewInputLimiter(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     LimitConfig
+		wantErr bool
+	}{
+		{"ok", LimitConfig{LinesPerSec: 10, SampleRate: 0.5}, false},
+		{"negative rate", LimitConfig{LinesPerSec: -1}, true},
+		{"bad sample rate", LimitConfig{SampleRate: 2}, true},
+		{"negative catchup lag", LimitConfig{CatchupLag: -1}, true},
+	}
+	for _, c := range cases {
+		if _, err := newInputLimiter("test", &c.cfg); (nil != err) != c.wantErr {
+			t.Errorf("%s: newInputLimiter err: %v, want err: %v", c.name, err, c.wantErr)
+		}
+	}
+}
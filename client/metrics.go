@@ -0,0 +1,211 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/common/clog"
+	"backend/common/httputil"
+	"github.com/zh4af/loggather/protocol"
+	"third/g2s"
+	"third/gin"
+	"third/go-metrics"
+)
+
+const (
+	DEFAULT_METRICS_INTERVAL = 10  // 秒
+	STATSD_SAMPLE_RATE       = 1.0 // 推送statsd不采样
+
+	METRICS_LAG_PREFIX  = "lag."
+	PROMETHEUS_LAG_NAME = "loggather_file_lag_bytes"
+)
+
+// MetricsConfig 客户端自身的统计, 所有统计都在go-metrics的默认registry中
+type MetricsConfig struct {
+	Listen       string // 本地查询地址, 如 127.0.0.1:2128, 不配置时不开启; GET /metrics为Prometheus格式, GET /metrics.json为JSON
+	StatsdAddr   string // statsd地址, 配置后定时推送, 连不上时只记日志, 不推送
+	StatsdPrefix string // statsd的bucket前缀, 默认 loggather.<主机名>
+	Interval     int    // 推送statsd和刷新文件积压的间隔(秒), 默认10
+}
+
+var gReadBytesCount = metrics.GetOrRegisterCounter("gather.bytes_read", nil)
+var gReadErrorCount = metrics.GetOrRegisterCounter("gather.read_errors", nil)
+
+var gLagGauges = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool, 1)}
+
+var gStatsdNamePattern = regexp.MustCompile(`[:|@/\s]`)
+
+func startMetrics(cfg MetricsConfig) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DEFAULT_METRICS_INTERVAL
+	}
+	interval := time.Duration(cfg.Interval) * time.Second
+
+	var router *gin.Engine
+	if cfg.Listen != "" {
+		router = gin.New()
+		router.Use(httputil.GinLogger())
+	}
+	var statter g2s.Statter
+	if cfg.StatsdAddr != "" {
+		var err error
+		if statter, err = g2s.Dial("udp", cfg.StatsdAddr); nil != err {
+			// 统计上报不可用时照常采集, 只是不推送
+			clog.Logger.Error("dial statsd: %s err: %v, skip statsd", cfg.StatsdAddr, err)
+			statter = nil
+		}
+	}
+	if statter != nil {
+		// GinStatter只用于统计查询接口本身, 按10%采样; 地址上面已经连通, 它不会因为连不上退出进程
+		if router != nil {
+			router.Use(httputil.GinStatter(cfg.StatsdAddr, ETCD_SERVICE_NAME))
+		}
+		prefix := cfg.StatsdPrefix
+		if prefix == "" {
+			prefix = ETCD_SERVICE_NAME + "." + strings.Replace(gAgent.Hostname, ".", "_", -1)
+		}
+		go pushStatsd(statter, prefix, interval)
+	} else {
+		go func() {
+			for range time.Tick(interval) {
+				updateLagGauges()
+			}
+		}()
+	}
+
+	if router != nil {
+		router.GET("/metrics", MetricsPrometheusHandle)
+		router.GET("/metrics.json", MetricsJsonHandle)
+		go func() {
+			if err := router.Run(cfg.Listen); nil != err {
+				clog.Logger.Error("start metrics server: %s err: %v", cfg.Listen, err)
+			}
+		}()
+	}
+}
+
+// 每个采集流一个gauge, 名字为 lag.<输入名>/<上报文件名>, 文件关闭后去掉
+func updateLagGauges() {
+	lags := streamLags()
+
+	gLagGauges.Lock()
+	defer gLagGauges.Unlock()
+	names := make(map[string]bool, len(lags))
+	for stream, lag := range lags {
+		name := METRICS_LAG_PREFIX + stream.input + "/" + stream.name
+		metrics.GetOrRegisterGauge(name, nil).Update(lag)
+		names[name] = true
+	}
+	for name := range gLagGauges.names {
+		if !names[name] {
+			metrics.Unregister(name)
+		}
+	}
+	gLagGauges.names = names
+}
+
+func MetricsJsonHandle(c *gin.Context) {
+	updateLagGauges()
+	buf, err := json.Marshal(metrics.DefaultRegistry)
+	if nil != err {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", buf)
+}
+
+func MetricsPrometheusHandle(c *gin.Context) {
+	updateLagGauges()
+	var buf bytes.Buffer
+	writePrometheus(&buf, metrics.DefaultRegistry)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
+
+func promLabel(v string) string {
+	return strconv.Quote(v)
+}
+
+// 文件积压合并为一个带input和file标签的指标, 其他的按名字输出
+func writePrometheus(w io.Writer, r metrics.Registry) {
+	is_lag := func(name string) bool { return strings.HasPrefix(name, METRICS_LAG_PREFIX) }
+	protocol.WritePrometheus(w, r, is_lag)
+
+	var lags []string
+	r.Each(func(name string, i interface{}) {
+		if is_lag(name) {
+			lags = append(lags, name)
+		}
+	})
+	if len(lags) == 0 {
+		return
+	}
+	sort.Strings(lags)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", PROMETHEUS_LAG_NAME)
+	for _, name := range lags {
+		g, ok := r.Get(name).(metrics.Gauge)
+		if !ok {
+			continue
+		}
+		stream := strings.SplitN(strings.TrimPrefix(name, METRICS_LAG_PREFIX), "/", 2)
+		if len(stream) != 2 {
+			continue
+		}
+		fmt.Fprintf(w, "%s{input=%s,file=%s} %d\n", PROMETHEUS_LAG_NAME, promLabel(stream[0]), promLabel(stream[1]), g.Value())
+	}
+}
+
+// 计数器和meter推送两次之间的增量, gauge推送当前值, 计时器和直方图推送中位数和99分位(计时器为毫秒)
+// 不用httputil的10%采样, 每个周期只发一次, 采样后gauge平均10个周期才更新一次
+func pushStatsd(statter g2s.Statter, prefix string, interval time.Duration) {
+	last := make(map[string]int64)
+	counter := func(name, bucket string, count int64) {
+		if delta := count - last[name]; delta > 0 {
+			statter.Counter(STATSD_SAMPLE_RATE, bucket, int(delta))
+		}
+		last[name] = count
+	}
+	gauge := func(bucket string, v float64) {
+		statter.Gauge(STATSD_SAMPLE_RATE, bucket, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+
+	for range time.Tick(interval) {
+		updateLagGauges()
+		metrics.Each(func(name string, i interface{}) {
+			bucket := prefix + "." + gStatsdNamePattern.ReplaceAllString(name, "_")
+			switch m := i.(type) {
+			case metrics.Counter:
+				counter(name, bucket, m.Count())
+			case metrics.Gauge:
+				statter.Gauge(STATSD_SAMPLE_RATE, bucket, strconv.FormatInt(m.Value(), 10))
+			case metrics.GaugeFloat64:
+				gauge(bucket, m.Value())
+			case metrics.Meter:
+				s := m.Snapshot()
+				counter(name, bucket, s.Count())
+				gauge(bucket+".rate1m", s.Rate1())
+			case metrics.Histogram:
+				s := m.Snapshot()
+				ps := s.Percentiles([]float64{0.5, 0.99})
+				gauge(bucket+".p50", ps[0])
+				gauge(bucket+".p99", ps[1])
+			case metrics.Timer:
+				s := m.Snapshot()
+				ps := s.Percentiles([]float64{0.5, 0.99})
+				statter.Gauge(STATSD_SAMPLE_RATE, bucket+".p50", strconv.FormatFloat(ps[0]/1e6, 'f', 3, 64))
+				statter.Gauge(STATSD_SAMPLE_RATE, bucket+".p99", strconv.FormatFloat(ps[1]/1e6, 'f', 3, 64))
+			}
+		})
+	}
+}
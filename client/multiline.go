@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"time"
+)
+
+const (
+	DEFAULT_MULTILINE_MAX_LINES     = 500
+	DEFAULT_MULTILINE_FLUSH_TIMEOUT = 5 // 秒
+)
+
+// MultilineConfig 多行事件合并规则, StartPattern和ContinuePattern只能配置一个
+// 例: clog日志(文件中带颜色控制符) StartPattern: ^(\x1b\[[0-9;]*m)?(DEBU|INFO|NOTI|WARN|ERRO|CRIT):
+// 例: go panic/java堆栈 ContinuePattern: ^(\s|$|goroutine |Caused by:)
+type MultilineConfig struct {
+	StartPattern    string // 匹配的行是一个新事件的开始, 其他行接在上一个事件后面
+	ContinuePattern string // 匹配的行接在上一个事件后面, 其他行是新事件
+	MaxLines        int    // 单个事件最多行数, 超过后强制切分, 默认500
+	FlushTimeout    int    // 文件多少秒不再增长后, 最后一个事件视为完整发送, 默认5秒
+}
+
+// eventSplitter 把读到的数据切在事件边界上, 为nil时按行切分
+type eventSplitter struct {
+	start        *regexp.Regexp
+	cont         *regexp.Regexp
+	maxLines     int
+	flushTimeout time.Duration
+}
+
+func newEventSplitter(cfg *MultilineConfig) (*eventSplitter, error) {
+	var err error
+
+	if cfg == nil {
+		return nil, nil
+	}
+	if (cfg.StartPattern == "") == (cfg.ContinuePattern == "") {
+		return nil, errors.New("multiline needs exactly one of StartPattern and ContinuePattern")
+	}
+
+	s := &eventSplitter{
+		maxLines:     cfg.MaxLines,
+		flushTimeout: time.Duration(cfg.FlushTimeout) * time.Second,
+	}
+	if cfg.StartPattern != "" {
+		if s.start, err = regexp.Compile(cfg.StartPattern); nil != err {
+			return nil, err
+		}
+	} else {
+		if s.cont, err = regexp.Compile(cfg.ContinuePattern); nil != err {
+			return nil, err
+		}
+	}
+	if s.maxLines <= 0 {
+		s.maxLines = DEFAULT_MULTILINE_MAX_LINES
+	}
+	if s.flushTimeout <= 0 {
+		s.flushTimeout = DEFAULT_MULTILINE_FLUSH_TIMEOUT * time.Second
+	}
+
+	return s, nil
+}
+
+func (s *eventSplitter) isStart(line []byte) bool {
+	if s.start != nil {
+		return s.start.Match(line)
+	}
+	return !s.cont.Match(line)
+}
+
+// FlushTimeout 按行切分时不需要等待
+func (s *eventSplitter) FlushTimeout() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return s.flushTimeout
+}
+
+// Each 按事件遍历buf, buf需要从事件开头开始, 按行切分时每行一个事件
+// 最后一个事件可能是被强制切开的, 不以换行结尾
+func (s *eventSplitter) Each(buf []byte, fn func(event []byte)) {
+	var ev_start, lines int
+	for pos := 0; pos < len(buf); {
+		end := len(buf)
+		if i := bytes.IndexByte(buf[pos:], '\n'); i >= 0 {
+			end = pos + i + 1
+		}
+		if pos > ev_start && (s == nil || lines >= s.maxLines || s.isStart(bytes.TrimRight(buf[pos:end], "\r\n"))) {
+			fn(buf[ev_start:pos])
+			ev_start = pos
+			lines = 0
+		}
+		lines++
+		pos = end
+	}
+	if ev_start < len(buf) {
+		fn(buf[ev_start:])
+	}
+}
+
+// Cut 返回buf中可以发送的长度, 剩下的部分留到下次从同一位置重新读取
+// buf总是从一个事件的开头开始
+// full: buf已经读满, 单个事件/单行比缓冲区还大时只能强制切开
+// flush: 文件已经读到末尾并且超过FlushTimeout没有增长, 最后一个事件视为完整
+func (s *eventSplitter) Cut(buf []byte, full, flush bool) int {
+	complete := bytes.LastIndexByte(buf, '\n') + 1
+	if complete == 0 {
+		// 一行都不完整
+		if full {
+			return len(buf)
+		}
+		return 0
+	}
+	if s == nil {
+		return complete
+	}
+
+	// 找到最后一个事件的开始位置, 之前的都是完整事件
+	var last_start, lines int
+	for pos := 0; pos < complete; {
+		end := pos + bytes.IndexByte(buf[pos:complete], '\n') + 1
+		if pos > 0 && (lines >= s.maxLines || s.isStart(bytes.TrimRight(buf[pos:end], "\r\n"))) {
+			last_start = pos
+			lines = 0
+		}
+		lines++
+		pos = end
+	}
+
+	if flush || (full && last_start == 0) {
+		return complete
+	}
+	return last_start
+}
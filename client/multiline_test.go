@@ -0,0 +1,92 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mustSplitter(t *testing.T, cfg *MultilineConfig) *eventSplitter {
+	s, err := newEventSplitter(cfg)
+	if nil != err {
+		t.Fatalf("newEventSplitter(%+v) err: %v", cfg, err)
+	}
+	return s
+}
+
+func TestNewEventSplitter(t *testing.T) {
+	cases := []struct {
+		cfg     *MultilineConfig
+		wantErr bool
+	}{
+		{nil, false},
+		{&MultilineConfig{StartPattern: `^INFO`}, false},
+		{&MultilineConfig{ContinuePattern: `^\s`}, false},
+		{&MultilineConfig{}, true},
+		{&MultilineConfig{StartPattern: `^INFO`, ContinuePattern: `^\s`}, true},
+		{&MultilineConfig{StartPattern: `(`}, true},
+	}
+	for _, c := range cases {
+		if _, err := newEventSplitter(c.cfg); (nil != err) != c.wantErr {
+			t.Errorf("newEventSplitter(%+v) err: %v, want err: %v", c.cfg, err, c.wantErr)
+		}
+	}
+}
+
+func TestEventSplitterEach(t *testing.T) {
+	start := &MultilineConfig{StartPattern: `^(INFO|ERRO):`}
+	cases := []struct {
+		name string
+		cfg  *MultilineConfig
+		buf  string
+		want []string
+	}{
+		{"lines", nil, "a\nb\n", []string{"a\n", "b\n"}},
+		{"lines without trailing newline", nil, "a\nb", []string{"a\n", "b"}},
+		{"start pattern", start, "INFO: a\n  at x\nERRO: b\n", []string{"INFO: a\n  at x\n", "ERRO: b\n"}},
+		{"crlf", start, "INFO: a\r\n x\r\nINFO: b\r\n", []string{"INFO: a\r\n x\r\n", "INFO: b\r\n"}},
+		{"continue pattern", &MultilineConfig{ContinuePattern: `^\s`}, "a\n b\nc\n", []string{"a\n b\n", "c\n"}},
+		{"max lines", &MultilineConfig{StartPattern: `^INFO`, MaxLines: 2}, "INFO: a\n1\n2\n", []string{"INFO: a\n1\n", "2\n"}},
+		{"empty", start, "", nil},
+	}
+	for _, c := range cases {
+		s := mustSplitter(t, c.cfg)
+		var got []string
+		s.Each([]byte(c.buf), func(event []byte) {
+			got = append(got, string(event))
+		})
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: Each(%q) = %q, want %q", c.name, c.buf, got, c.want)
+		}
+	}
+}
+
+func TestEventSplitterCut(t *testing.T) {
+	start := &MultilineConfig{StartPattern: `^INFO`}
+	cases := []struct {
+		name  string
+		cfg   *MultilineConfig
+		buf   string
+		full  bool
+		flush bool
+		want  int
+	}{
+		{"lines keep complete lines", nil, "a\nb", false, false, 2},
+		{"no complete line", nil, "abc", false, false, 0},
+		{"no complete line full buffer", nil, "abc", true, false, 3},
+		// 最后一个事件后面可能还有续行, 留到下次读取
+		{"hold last event", start, "INFO a\n x\nINFO b\n", false, false, 10},
+		{"flush last event", start, "INFO a\n x\nINFO b\n", false, true, 17},
+		{"partial line", start, "INFO a\n x\nINFO b", false, false, 0},
+		{"partial line flush", start, "INFO a\n x\nINFO b", false, true, 10},
+		// 缓冲区里只有一个事件时强制切开
+		{"single event full buffer", start, "INFO a\n x\n", true, false, 10},
+		{"single event not full", start, "INFO a\n x\n", false, false, 0},
+		{"max lines", &MultilineConfig{StartPattern: `^INFO`, MaxLines: 2}, "INFO a\n1\n2\n", false, false, 9},
+	}
+	for _, c := range cases {
+		s := mustSplitter(t, c.cfg)
+		if got := s.Cut([]byte(c.buf), c.full, c.flush); got != c.want {
+			t.Errorf("%s: Cut(%q, %v, %v) = %d, want %d", c.name, c.buf, c.full, c.flush, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"backend/common/clog"
+)
+
+const (
+	FINGERPRINT_SIZE = 256 // 取文件头部多少字节计算指纹
+)
+
+// FileRecord 单个文件(按device+inode区分)的采集进度
+type FileRecord struct {
+	Input       string `json:"input"` // 所属输入
+	Name        string `json:"name"`  // 上报使用的文件名, 文件被改名后仍沿用原来的名字直到读完
+	Path        string `json:"path"`  // 最近一次看到的路径
+	Dev         uint64 `json:"dev"`
+	Ino         uint64 `json:"ino"`
+	Fingerprint uint32 `json:"fingerprint"` // 文件头部FpLen字节的crc32, 用来识别inode复用
+	FpLen       int    `json:"fp_len"`
+	Offset      int64  `json:"offset"`  // 已经上报的位置
+	Uid         string `json:"uid"`     // 文件实例的随机标识, 截断或内容被替换后重新生成, 服务端按它去重
+	Rotated     bool   `json:"rotated"` // 已被改名/移走/删除, 读完后关闭
+	Drained     bool   `json:"drained"` // 轮转的文件已经读完, 仍留在目录中时不再重复采集
+}
+
+type LogFileRecordInfo struct {
+	Data map[string]*FileRecord `json:"data"` // key: dev:ino
+	sync.Mutex
+}
+
+// 旧版本记录格式 {"data":{"file1":10,"file2":2}} key:文件名 value:读取的位置
+type legacyRecordInfo struct {
+	Data map[string]int `json:"data"`
+}
+
+var gRecordInfo LogFileRecordInfo
+
+// 多个采集流会并发保存, 序号保证旧的快照不会覆盖新的
+var gRecordSave = struct {
+	sync.Mutex
+	seq   uint64 // 最新快照的序号, gRecordInfo锁内递增
+	saved uint64 // 已经写入的快照序号
+}{}
+
+// 旧格式的记录, 文件第一次被打开时按文件名迁移
+var gLegacyOffsets map[string]int
+
+func fileKey(dev, ino uint64) string {
+	return fmt.Sprintf("%d:%d", dev, ino)
+}
+
+func loadRecordInfo() error {
+	buf, err := gCheckpoint.Load()
+	if nil != err {
+		return err
+	}
+
+	// 旧版本截断后在原偏移处写入, 文件头部会留下一段\0
+	buf = bytes.TrimLeft(buf, "\x00")
+	gRecordInfo.Data = make(map[string]*FileRecord, 1)
+	if len(buf) <= 0 {
+		return nil
+	}
+
+	var info LogFileRecordInfo
+	if err = json.Unmarshal(buf, &info); nil == err {
+		for key, rec := range info.Data {
+			if rec.Input == "" {
+				rec.Input = gInputs[0].Name
+			}
+			// 输入已经从配置中去掉
+			if inputByName(rec.Input) == nil {
+				continue
+			}
+			gRecordInfo.Data[key] = rec
+		}
+		return nil
+	}
+
+	var legacy legacyRecordInfo
+	if legacy_err := json.Unmarshal(buf, &legacy); nil != legacy_err {
+		return err
+	}
+	clog.Logger.Info("migrate legacy record info: %v", legacy.Data)
+	gLegacyOffsets = legacy.Data
+	return nil
+}
+
+// 旧格式的记录只在启动后第一次全量扫描时使用
+func dropLegacyOffsets() {
+	gRecordInfo.Lock()
+	gLegacyOffsets = nil
+	gRecordInfo.Unlock()
+}
+
+func saveRecordInfo() {
+	gRecordInfo.Lock()
+	buf, err := json.Marshal(&gRecordInfo)
+	gRecordSave.seq++
+	seq := gRecordSave.seq
+	gRecordInfo.Unlock()
+	if nil != err {
+		clog.Logger.Error("encode record info err: %v", err)
+		return
+	}
+
+	// 写入较慢, 不占用gRecordInfo锁
+	gRecordSave.Lock()
+	defer gRecordSave.Unlock()
+	if seq <= gRecordSave.saved {
+		return
+	}
+	if err = gCheckpoint.Save(buf); nil != err {
+		clog.Logger.Error("save record info err: %v", err)
+		return
+	}
+	gRecordSave.saved = seq
+}
+
+func newFileUid() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// 从头重新采集, 服务端视为新的文件实例
+// 调用方需持有gRecordInfo锁
+func resetRecord(rec *FileRecord) {
+	rec.Offset = 0
+	rec.FpLen = 0
+	rec.Uid = newFileUid()
+}
+
+// 读取文件头部n字节计算指纹
+func fileFingerprint(fp *os.File, n int) (uint32, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	buf := make([]byte, n)
+	if _, err := fp.ReadAt(buf, 0); nil != err && err != io.EOF {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(buf), nil
+}
+
+// 校验文件头部是否还是记录中的内容, 并在文件变大时补全指纹
+// 调用方需持有gRecordInfo锁
+func verifyFingerprint(fp *os.File, rec *FileRecord, size int64) (bool, error) {
+	if int64(rec.FpLen) > size {
+		return false, nil
+	}
+	if rec.FpLen > 0 {
+		sum, err := fileFingerprint(fp, rec.FpLen)
+		if nil != err {
+			return false, err
+		}
+		if sum != rec.Fingerprint {
+			return false, nil
+		}
+	}
+	if rec.FpLen < FINGERPRINT_SIZE && size > int64(rec.FpLen) {
+		fp_len := FINGERPRINT_SIZE
+		if size < int64(fp_len) {
+			fp_len = int(size)
+		}
+		sum, err := fileFingerprint(fp, fp_len)
+		if nil != err {
+			return false, err
+		}
+		rec.Fingerprint = sum
+		rec.FpLen = fp_len
+	}
+	return true, nil
+}
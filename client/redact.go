@@ -0,0 +1,205 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+
+	"backend/common/clog"
+	"third/go-metrics"
+)
+
+const (
+	REDACT_MASK = "mask" // 默认, 内置检测器保留首尾几位, 自定义规则整体替换为******
+	REDACT_HASH = "hash" // 替换为HMAC-SHA256的前16位, 同一个值结果相同, 仍可以关联查询
+	REDACT_DROP = "drop" // 丢弃整个事件
+
+	REDACT_CUSTOM_MASK = "******"
+	REDACT_HASH_LEN    = 16
+)
+
+// RedactConfig 发送前脱敏, 在过滤之后, 压缩之前, 按规则顺序依次替换
+type RedactConfig struct {
+	Rules   []RedactRule
+	HashKey string // hash模式的HMAC密钥, 不配置时手机号等取值范围小的数据可以被穷举还原
+}
+
+// RedactRule Name为内置检测器时不需要Pattern
+type RedactRule struct {
+	Name    string // 内置: mobile(大陆手机号)/email/idcard(身份证号)/bearer(Bearer token); 自定义规则任意取名
+	Pattern string // 自定义规则的正则, 有分组时只替换第一个分组, 如 password=(\S+)
+	Mode    string // mask(默认)/hash/drop
+}
+
+type redactDetector struct {
+	pattern  string
+	mask     func(v []byte) []byte
+	digitEnd bool // 替换的部分后面不能紧跟数字
+}
+
+// 手机号可能带+86/86前缀, 前后不能是数字; \b在"+"和字母之后不算边界, 改用非数字匹配
+// RE2不支持向后断言, 结尾如果也匹配一个非数字, 逗号隔开的两个号码中第二个会漏掉, 所以结尾在替换时检查
+var redactDetectors = map[string]redactDetector{
+	"mobile": {`(?:^|[^0-9])((?:\+?86[- ]?)?1[3-9][0-9]{9})`, maskMobile, true},
+	"email":  {`\b[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}\b`, maskEmail, false},
+	"idcard": {`\b[1-9][0-9]{5}(18|19|20)[0-9]{2}(0[1-9]|1[0-2])(0[1-9]|[12][0-9]|3[01])[0-9]{3}[0-9Xx]\b`, func(v []byte) []byte { return maskMiddle(v, 6, 4) }, false},
+	"bearer": {`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`, nil, false},
+}
+
+type redactRule struct {
+	name     string
+	re       *regexp.Regexp
+	group    bool // 只替换第一个分组
+	digitEnd bool
+	mode     string
+	mask     func(v []byte) []byte
+
+	matchCount metrics.Counter
+}
+
+type redactor struct {
+	rules   []*redactRule
+	hashKey []byte
+
+	droppedCount metrics.Counter
+}
+
+func newRedactor(input string, cfg *RedactConfig) (*redactor, error) {
+	if cfg == nil || len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	r := &redactor{
+		hashKey:      []byte(cfg.HashKey),
+		droppedCount: metrics.GetOrRegisterCounter("redact."+input+".dropped", nil),
+	}
+	for _, c := range cfg.Rules {
+		if c.Name == "" {
+			return nil, errors.New("redact rule without name")
+		}
+		rule := &redactRule{
+			name:       c.Name,
+			mode:       c.Mode,
+			mask:       func(v []byte) []byte { return []byte(REDACT_CUSTOM_MASK) },
+			matchCount: metrics.GetOrRegisterCounter("redact."+input+"."+c.Name, nil),
+		}
+		pattern := c.Pattern
+		if d, ok := redactDetectors[c.Name]; ok && pattern == "" {
+			pattern = d.pattern
+			rule.digitEnd = d.digitEnd
+			if d.mask != nil {
+				rule.mask = d.mask
+			}
+		}
+		if pattern == "" {
+			return nil, errors.New("redact rule " + c.Name + " needs pattern")
+		}
+		switch rule.mode {
+		case "":
+			rule.mode = REDACT_MASK
+		case REDACT_MASK, REDACT_HASH, REDACT_DROP:
+		default:
+			return nil, errors.New("redact rule " + c.Name + " unknown mode: " + c.Mode)
+		}
+		if rule.mode == REDACT_HASH && cfg.HashKey == "" {
+			clog.Logger.Warning("input %s redact rule %s hash without HashKey", input, c.Name)
+		}
+
+		var err error
+		if rule.re, err = regexp.Compile(pattern); nil != err {
+			return nil, err
+		}
+		// 内置的身份证号规则中的分组只用来限定日期
+		rule.group = rule.re.NumSubexp() > 0 && c.Name != "idcard"
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// Redact 返回脱敏后的事件, 命中drop规则时返回nil
+func (r *redactor) Redact(event []byte) []byte {
+	for _, rule := range r.rules {
+		spans := rule.find(event)
+		if len(spans) == 0 {
+			continue
+		}
+		rule.matchCount.Inc(int64(len(spans)))
+		if rule.mode == REDACT_DROP {
+			r.droppedCount.Inc(1)
+			return nil
+		}
+
+		out := make([]byte, 0, len(event))
+		var last int
+		for _, span := range spans {
+			out = append(out, event[last:span[0]]...)
+			out = append(out, r.replace(rule, event[span[0]:span[1]])...)
+			last = span[1]
+		}
+		event = append(out, event[last:]...)
+	}
+	return event
+}
+
+// find 返回要替换的各段起止位置
+func (rule *redactRule) find(event []byte) [][2]int {
+	var spans [][2]int
+	for _, loc := range rule.re.FindAllSubmatchIndex(event, -1) {
+		start, end := loc[0], loc[1]
+		if rule.group {
+			if loc[2] < 0 {
+				continue
+			}
+			start, end = loc[2], loc[3]
+		}
+		if rule.digitEnd && end < len(event) && event[end] >= '0' && event[end] <= '9' {
+			continue
+		}
+		spans = append(spans, [2]int{start, end})
+	}
+	return spans
+}
+
+func (r *redactor) replace(rule *redactRule, v []byte) []byte {
+	if rule.mode == REDACT_HASH {
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write(v)
+		return []byte("<hash:" + hex.EncodeToString(mac.Sum(nil))[:REDACT_HASH_LEN] + ">")
+	}
+	return rule.mask(v)
+}
+
+// 保留首尾各几位, 太短时全部替换
+func maskMiddle(v []byte, head, tail int) []byte {
+	out := make([]byte, len(v))
+	for i := range v {
+		if len(v) > head+tail && (i < head || i >= len(v)-tail) {
+			out[i] = v[i]
+		} else {
+			out[i] = '*'
+		}
+	}
+	return out
+}
+
+// 国家码前缀不变, 号码保留前3位和后4位
+func maskMobile(v []byte) []byte {
+	n := len(v) - 11
+	return append(append([]byte{}, v[:n]...), maskMiddle(v[n:], 3, 4)...)
+}
+
+// 用户名只保留第一位, 域名不变
+func maskEmail(v []byte) []byte {
+	at := len(v)
+	for i := range v {
+		if v[i] == '@' {
+			at = i
+			break
+		}
+	}
+	out := make([]byte, 0, len(v)+3)
+	out = append(out, v[0])
+	out = append(out, "***"...)
+	return append(out, v[at:]...)
+}
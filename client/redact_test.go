@@ -0,0 +1,91 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestNewRedactor(t *testing.T) {
+	cases := []struct {
+		name    string
+		rules   []RedactRule
+		wantErr bool
+	}{
+		{"builtin", []RedactRule{{Name: "mobile"}, {Name: "email"}, {Name: "idcard"}, {Name: "bearer"}}, false},
+		{"custom", []RedactRule{{Name: "password", Pattern: `password=(\S+)`, Mode: REDACT_HASH}}, false},
+		{"no name", []RedactRule{{Pattern: `x`}}, true},
+		{"custom without pattern", []RedactRule{{Name: "password"}}, true},
+		{"unknown mode", []RedactRule{{Name: "mobile", Mode: "erase"}}, true},
+		{"bad pattern", []RedactRule{{Name: "bad", Pattern: `(`}}, true},
+	}
+	for _, c := range cases {
+		if _, err := newRedactor("test", &RedactConfig{Rules: c.rules}); (nil != err) != c.wantErr {
+			t.Errorf("%s: newRedactor err: %v, want err: %v", c.name, err, c.wantErr)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules []RedactRule
+		event string
+		want  string
+	}{
+		{"mobile", []RedactRule{{Name: "mobile"}}, "call 13812345678 now\n", "call 138****5678 now\n"},
+		{"mobile inside longer number", []RedactRule{{Name: "mobile"}}, "order 213812345678\n", "order 213812345678\n"},
+		{"mobile with +86", []RedactRule{{Name: "mobile"}}, "call +8613812345678 now\n", "call +86138****5678 now\n"},
+		{"mobile with 86", []RedactRule{{Name: "mobile"}}, "tel:8613812345678\n", "tel:86138****5678\n"},
+		{"mobile with 86 and dash", []RedactRule{{Name: "mobile"}}, "+86-13812345678\n", "+86-138****5678\n"},
+		{"mobile after letter", []RedactRule{{Name: "mobile"}}, "uid=1,mobile13812345678\n", "uid=1,mobile138****5678\n"},
+		{"mobile followed by digit", []RedactRule{{Name: "mobile"}}, "order 138123456789\n", "order 138123456789\n"},
+		{"mobile twice", []RedactRule{{Name: "mobile"}}, "13812345678,13987654321\n", "138****5678,139****4321\n"},
+		{"email", []RedactRule{{Name: "email"}}, "to bob.smith@example.com.\n", "to b***@example.com.\n"},
+		{"idcard", []RedactRule{{Name: "idcard"}}, "id 11010119900307123X ok\n", "id 110101********123X ok\n"},
+		{"idcard bad date", []RedactRule{{Name: "idcard"}}, "id 110101199013071234\n", "id 110101199013071234\n"},
+		{"bearer", []RedactRule{{Name: "bearer"}}, "Authorization: Bearer abc.DEF-123==\n", "Authorization: Bearer ******\n"},
+		{"custom group", []RedactRule{{Name: "password", Pattern: `password=(\S+)`}}, "login password=s3cret user=x\n", "login password=****** user=x\n"},
+		{"custom whole match", []RedactRule{{Name: "token", Pattern: `tk_[a-z0-9]+`}}, "use tk_abc123\n", "use ******\n"},
+		{"no match", []RedactRule{{Name: "mobile"}}, "nothing here\n", "nothing here\n"},
+		{"rules in order", []RedactRule{{Name: "email"}, {Name: "mobile"}}, "13812345678 a@b.cn\n", "138****5678 a***@b.cn\n"},
+	}
+	for _, c := range cases {
+		r, err := newRedactor("test", &RedactConfig{Rules: c.rules})
+		if nil != err {
+			t.Fatalf("%s: newRedactor err: %v", c.name, err)
+		}
+		if got := string(r.Redact([]byte(c.event))); got != c.want {
+			t.Errorf("%s: Redact(%q) = %q, want %q", c.name, c.event, got, c.want)
+		}
+	}
+}
+
+func TestRedactHashAndDrop(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("13812345678"))
+	hashed := "<hash:" + hex.EncodeToString(mac.Sum(nil))[:REDACT_HASH_LEN] + ">"
+
+	cases := []struct {
+		name  string
+		rules []RedactRule
+		event string
+		want  []byte
+	}{
+		{"hash", []RedactRule{{Name: "mobile", Mode: REDACT_HASH}}, "u 13812345678\n", []byte("u " + hashed + "\n")},
+		{"drop", []RedactRule{{Name: "password", Pattern: `password=`, Mode: REDACT_DROP}}, "password=x\n", nil},
+		{"drop mobile followed by digit", []RedactRule{{Name: "mobile", Mode: REDACT_DROP}}, "id 138123456789\n", []byte("id 138123456789\n")},
+		{"drop no match", []RedactRule{{Name: "password", Pattern: `password=`, Mode: REDACT_DROP}}, "user=x\n", []byte("user=x\n")},
+	}
+	for _, c := range cases {
+		r, err := newRedactor("test", &RedactConfig{Rules: c.rules, HashKey: "key"})
+		if nil != err {
+			t.Fatalf("%s: newRedactor err: %v", c.name, err)
+		}
+		got := r.Redact([]byte(c.event))
+		if (got == nil) != (c.want == nil) || string(got) != string(c.want) {
+			t.Errorf("%s: Redact(%q) = %q, want %q", c.name, c.event, got, c.want)
+		}
+	}
+}
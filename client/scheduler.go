@@ -0,0 +1,186 @@
+package client
+
+import (
+	"container/heap"
+	"sync"
+
+	"third/go-metrics"
+)
+
+const (
+	DEFAULT_GATHER_WORKERS = 8
+	DEFAULT_GATHER_QUANTUM = 10 // 块, 每块SINGLE_GATHER_NUM
+	GATHER_ROUND_STEP      = 64 // 优先级为0的采集流每采集一轮轮次增加多少
+	GATHER_MAX_PRIORITY    = 6  // 优先级按这个范围计算份额, 超出的和边界一样
+)
+
+// SchedulerConfig 采集协程池, 所有输入共用
+type SchedulerConfig struct {
+	Workers int // 同时采集的文件数, 默认8
+	Quantum int // 一个文件每轮最多连续发送多少块(每块100K), 还有积压时让出, 默认10
+}
+
+// gatherJob 排队等待采集的一个采集流
+type gatherJob struct {
+	in      *gatherInput
+	stream  streamKey
+	st      *gatherState
+	wg      *sync.WaitGroup
+	round   uint64 // 轮次, 小的先采集, 每采集完一轮按优先级增加
+	backlog int64  // 入队时未读的字节数
+	seq     uint64 // 入队顺序
+}
+
+// 按轮次采集, 每个文件每轮最多Quantum块, 大文件不会一直占着协程; 同一轮中积压多的先采集
+// 优先级高的每采集一轮轮次涨得慢, 都有积压时按份额分配, 优先级低的一直在等也会轮到
+type gatherQueue []*gatherJob
+
+func (q gatherQueue) Len() int { return len(q) }
+
+func (q gatherQueue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+	if a.round != b.round {
+		return a.round < b.round
+	}
+	if a.backlog != b.backlog {
+		return a.backlog > b.backlog
+	}
+	return a.seq < b.seq
+}
+
+func (q gatherQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *gatherQueue) Push(x interface{}) {
+	*q = append(*q, x.(*gatherJob))
+}
+
+func (q *gatherQueue) Pop() interface{} {
+	old := *q
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return job
+}
+
+type gatherScheduler struct {
+	quantum int
+
+	sync.Mutex
+	cond  *sync.Cond
+	queue gatherQueue
+	round uint64 // 最近开始采集的轮次, 新入队的采集流从这一轮开始, 不会插到一直在排队的大文件前面太多
+	seq   uint64
+	busy  int64
+
+	queueGauge metrics.Gauge
+	busyGauge  metrics.Gauge
+}
+
+var gScheduler *gatherScheduler
+
+func newGatherScheduler(cfg SchedulerConfig) *gatherScheduler {
+	if cfg.Workers <= 0 {
+		cfg.Workers = DEFAULT_GATHER_WORKERS
+	}
+	if cfg.Quantum <= 0 {
+		cfg.Quantum = DEFAULT_GATHER_QUANTUM
+	}
+	s := &gatherScheduler{
+		quantum:    cfg.Quantum,
+		queueGauge: metrics.GetOrRegisterGauge("gather.queued", nil),
+		busyGauge:  metrics.GetOrRegisterGauge("gather.busy", nil),
+	}
+	s.cond = sync.NewCond(&s.Mutex)
+	for i := 0; i < cfg.Workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// Submit 采集流开始排队, 调用方已经把它标记为running
+// 上次采集到的轮次保存在st中, 刚采集完又有数据的文件不会排到一直在等的文件前面
+func (s *gatherScheduler) Submit(in *gatherInput, stream streamKey, st *gatherState, wg *sync.WaitGroup) {
+	job := &gatherJob{in: in, stream: stream, st: st, wg: wg}
+	s.Lock()
+	job.round = s.round
+	s.Unlock()
+	if st.round > job.round {
+		job.round = st.round
+	}
+	s.push(job)
+}
+
+func (s *gatherScheduler) push(job *gatherJob) {
+	job.backlog = streamBacklog(job.stream.input, job.stream.name)
+	s.Lock()
+	s.seq++
+	job.seq = s.seq
+	heap.Push(&s.queue, job)
+	s.queueGauge.Update(int64(len(s.queue)))
+	s.Unlock()
+	s.cond.Signal()
+}
+
+func (s *gatherScheduler) pop() *gatherJob {
+	s.Lock()
+	defer s.Unlock()
+	for len(s.queue) == 0 {
+		s.cond.Wait()
+	}
+	job := heap.Pop(&s.queue).(*gatherJob)
+	if job.round > s.round {
+		s.round = job.round
+	}
+	s.busy++
+	s.queueGauge.Update(int64(len(s.queue)))
+	s.busyGauge.Update(s.busy)
+	return job
+}
+
+func (s *gatherScheduler) done() {
+	s.Lock()
+	s.busy--
+	s.busyGauge.Update(s.busy)
+	s.Unlock()
+}
+
+// roundStep 采集一轮后轮次增加多少, 优先级每高一级份额多一倍
+func roundStep(priority int) uint64 {
+	if priority > GATHER_MAX_PRIORITY {
+		priority = GATHER_MAX_PRIORITY
+	} else if priority < -GATHER_MAX_PRIORITY {
+		priority = -GATHER_MAX_PRIORITY
+	}
+	if priority >= 0 {
+		return GATHER_ROUND_STEP >> uint(priority)
+	}
+	return GATHER_ROUND_STEP << uint(-priority)
+}
+
+func (s *gatherScheduler) work() {
+	for {
+		job := s.pop()
+		more := runGather(job.in, job.stream.name, s.quantum)
+		s.done()
+
+		// 每采集完一轮都保存进度并放开等待的扫描, 一直在写的文件不会让扫描一直等下去
+		if job.wg != nil {
+			job.wg.Done()
+		} else {
+			saveRecordInfo()
+		}
+
+		next := job.round + roundStep(job.in.Priority)
+		gGathering.Lock()
+		job.st.round = next
+		if !more && !job.st.pending {
+			job.st.running = false
+			gGathering.Unlock()
+			continue
+		}
+		// 用完了这一轮的量或者采集过程中又有新的写入, 作为新的任务排到同一轮的其他文件后面
+		job.st.pending = false
+		gGathering.Unlock()
+		s.push(&gatherJob{in: job.in, stream: job.stream, st: job.st, round: next})
+	}
+}
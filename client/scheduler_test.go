@@ -0,0 +1,58 @@
+package client
+
+import (
+	"sync"
+	"testing"
+
+	"third/go-metrics"
+)
+
+// 高优先级的文件一直有积压时, 低优先级的文件也按份额采集
+func TestSchedulerLowPriorityProgress(t *testing.T) {
+	// 没有采集协程, 由测试自己出队
+	s := &gatherScheduler{quantum: DEFAULT_GATHER_QUANTUM, queueGauge: metrics.NewGauge(), busyGauge: metrics.NewGauge()}
+	s.cond = sync.NewCond(&s.Mutex)
+
+	high := &gatherInput{InputConfig: InputConfig{Name: "high", Priority: 2}}
+	low := &gatherInput{InputConfig: InputConfig{Name: "low"}}
+	s.push(&gatherJob{in: high, stream: streamKey{input: "high", name: "high.log"}})
+	s.push(&gatherJob{in: low, stream: streamKey{input: "low", name: "low.log"}})
+
+	counts := make(map[string]int)
+	first_low := -1
+	for i := 0; i < 100; i++ {
+		job := s.pop()
+		s.done()
+		counts[job.in.Name]++
+		if job.in == low && first_low < 0 {
+			first_low = i
+		}
+		// 两个文件都一直有积压, 采集完一轮就重新排队
+		s.push(&gatherJob{in: job.in, stream: job.stream, round: job.round + roundStep(job.in.Priority)})
+	}
+	if first_low < 0 || first_low > 5 {
+		t.Errorf("low priority file first gathered at %d, want within 5 rounds", first_low)
+	}
+	// 优先级高2级, 份额是4:1
+	if counts["low"] < 15 || counts["high"] < 75 {
+		t.Errorf("gathered high %d low %d, want about 80:20", counts["high"], counts["low"])
+	}
+}
+
+func TestRoundStep(t *testing.T) {
+	cases := []struct {
+		priority int
+		want     uint64
+	}{
+		{0, GATHER_ROUND_STEP},
+		{1, GATHER_ROUND_STEP / 2},
+		{-1, GATHER_ROUND_STEP * 2},
+		{100, GATHER_ROUND_STEP >> GATHER_MAX_PRIORITY},
+		{-100, GATHER_ROUND_STEP << GATHER_MAX_PRIORITY},
+	}
+	for _, c := range cases {
+		if got := roundStep(c.priority); got != c.want {
+			t.Errorf("roundStep(%d) = %d, want %d", c.priority, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,501 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/common/clog"
+	"github.com/zh4af/loggather/protocol"
+	"third/go-metrics"
+)
+
+const (
+	SPOOL_DIR_NAME              = "spool"            // 默认和进度文件放在同一个目录
+	DEFAULT_SPOOL_MAX_BYTES     = 1024 * 1024 * 1024 // 1G
+	DEFAULT_SPOOL_MAX_AGE       = 7 * 24 * 3600      // 秒
+	DEFAULT_SPOOL_SEGMENT_BYTES = 16 * 1024 * 1024   // 16M
+
+	SPOOL_SEGMENT_SUFFIX = ".seg"
+	SPOOL_ACK_FILE       = "spool.ack"
+	SPOOL_RECORD_HEADER  = 8 // 4字节长度 + 4字节crc32
+	SPOOL_RETRY_INTERVAL = time.Second * 5
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+// SpoolConfig 上报失败的数据先落盘, 服务端恢复后按顺序重发
+type SpoolConfig struct {
+	Disable      bool
+	Dir          string // 默认进度文件所在目录下的spool
+	MaxBytes     int64  // 落盘数据上限, 超过后丢弃最旧的分段, 默认1G
+	MaxAge       int    // 数据最长保留多少秒, 默认7天
+	SegmentBytes int64  // 单个分段文件大小, 默认16M
+}
+
+// spoolBatch 一个已经读取并压缩, 但服务端还没确认的上报
+type spoolBatch struct {
+	Url    string                   `json:"url"`
+	Time   int64                    `json:"time"`
+	Report protocol.LogGatherReport `json:"report"`
+}
+
+type spoolPos struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+type spoolSegment struct {
+	id   int64
+	size int64
+}
+
+// diskSpool 分段的预写日志, 追加写入最后一个分段, 从ack位置开始按顺序读取
+type diskSpool struct {
+	sync.Mutex
+	cfg      SpoolConfig
+	maxAge   time.Duration
+	segments []*spoolSegment
+	writer   *os.File
+	ack      spoolPos
+	bytes    int64 // 未确认的字节数
+	batches  int64 // 未确认的batch数
+	notify   chan struct{}
+
+	bytesGauge    metrics.Gauge
+	batchesGauge  metrics.Gauge
+	segmentsGauge metrics.Gauge
+	droppedCount  metrics.Counter
+}
+
+var gSpool *diskSpool
+
+func newDiskSpool(cfg SpoolConfig) (*diskSpool, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Join(filepath.Dir(defaultCheckpointPath()), SPOOL_DIR_NAME)
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DEFAULT_SPOOL_MAX_BYTES
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = DEFAULT_SPOOL_MAX_AGE
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = DEFAULT_SPOOL_SEGMENT_BYTES
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); nil != err {
+		return nil, err
+	}
+	clog.Logger.Info("spool dir: %s", cfg.Dir)
+
+	s := &diskSpool{
+		cfg:           cfg,
+		maxAge:        time.Duration(cfg.MaxAge) * time.Second,
+		notify:        make(chan struct{}, 1),
+		bytesGauge:    metrics.GetOrRegisterGauge("spool.bytes", nil),
+		batchesGauge:  metrics.GetOrRegisterGauge("spool.batches", nil),
+		segmentsGauge: metrics.GetOrRegisterGauge("spool.segments", nil),
+		droppedCount:  metrics.GetOrRegisterCounter("spool.dropped", nil),
+	}
+	if err := s.load(); nil != err {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *diskSpool) segmentPath(id int64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%016d%s", id, SPOOL_SEGMENT_SUFFIX))
+}
+
+// 启动时恢复分段和ack位置, 截掉最后一个分段中崩溃时没写完的记录
+func (s *diskSpool) load() error {
+	infos, err := ioutil.ReadDir(s.cfg.Dir)
+	if nil != err {
+		return err
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), SPOOL_SEGMENT_SUFFIX) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(info.Name(), SPOOL_SEGMENT_SUFFIX), 10, 64)
+		if nil != err {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{id: id, size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	if buf, err := ioutil.ReadFile(filepath.Join(s.cfg.Dir, SPOOL_ACK_FILE)); nil == err {
+		if err = json.Unmarshal(buf, &s.ack); nil != err {
+			clog.Logger.Error("decode spool ack err: %v, replay from oldest segment", err)
+			s.ack = spoolPos{}
+		}
+	}
+
+	// ack之前的分段已经发送完
+	for len(s.segments) > 0 && s.segments[0].id < s.ack.Segment {
+		os.Remove(s.segmentPath(s.segments[0].id))
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) == 0 || s.segments[0].id != s.ack.Segment {
+		s.ack.Offset = 0
+		if len(s.segments) > 0 {
+			s.ack.Segment = s.segments[0].id
+		}
+	}
+
+	if len(s.segments) > 0 {
+		last := s.segments[len(s.segments)-1]
+		valid, err := s.scanSegment(last.id)
+		if nil != err {
+			return err
+		}
+		if valid < last.size {
+			clog.Logger.Warning("spool segment %d truncated from %d to %d", last.id, last.size, valid)
+			if err = os.Truncate(s.segmentPath(last.id), valid); nil != err {
+				return err
+			}
+			last.size = valid
+		}
+		s.writer, err = os.OpenFile(s.segmentPath(last.id), os.O_WRONLY|os.O_APPEND, 0644)
+		if nil != err {
+			return err
+		}
+	}
+
+	// 统计未确认的数据
+	for i, seg := range s.segments {
+		s.bytes += seg.size
+		if i == 0 && seg.id == s.ack.Segment {
+			s.bytes -= s.ack.Offset
+		}
+		s.batches += s.countRecords(seg.id, s.startOffset(seg.id))
+	}
+	s.updateMetrics()
+	if s.batches > 0 {
+		clog.Logger.Info("spool has %d batches %d bytes to replay", s.batches, s.bytes)
+	}
+	return nil
+}
+
+func (s *diskSpool) startOffset(id int64) int64 {
+	if id == s.ack.Segment {
+		return s.ack.Offset
+	}
+	return 0
+}
+
+// 返回分段中最后一条完整记录的结束位置
+func (s *diskSpool) scanSegment(id int64) (int64, error) {
+	fp, err := os.Open(s.segmentPath(id))
+	if nil != err {
+		return 0, err
+	}
+	defer fp.Close()
+
+	var valid int64
+	r := bufio.NewReader(fp)
+	for {
+		payload, err := readSpoolRecord(r)
+		if nil != err {
+			return valid, nil
+		}
+		valid += int64(SPOOL_RECORD_HEADER + len(payload))
+	}
+}
+
+func (s *diskSpool) countRecords(id int64, offset int64) int64 {
+	fp, err := os.Open(s.segmentPath(id))
+	if nil != err {
+		return 0
+	}
+	defer fp.Close()
+	if _, err = fp.Seek(offset, io.SeekStart); nil != err {
+		return 0
+	}
+
+	var n int64
+	r := bufio.NewReader(fp)
+	for {
+		if _, err := readSpoolRecord(r); nil != err {
+			return n
+		}
+		n++
+	}
+}
+
+func readSpoolRecord(r io.Reader) ([]byte, error) {
+	var header [SPOOL_RECORD_HEADER]byte
+	if _, err := io.ReadFull(r, header[:]); nil != err {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); nil != err {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, errors.New("spool record checksum mismatch")
+	}
+	return payload, nil
+}
+
+// Pending 还有没发送完的数据时, 新数据也要排在后面保证顺序
+func (s *diskSpool) Pending() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.batches > 0
+}
+
+// Backlog 未确认的字节数
+func (s *diskSpool) Backlog() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.bytes
+}
+
+// Append 写入并fsync, 返回后数据已经持久化, 可以推进采集记录
+func (s *diskSpool) Append(b *spoolBatch) error {
+	payload, err := json.Marshal(b)
+	if nil != err {
+		return err
+	}
+	record := make([]byte, SPOOL_RECORD_HEADER+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[SPOOL_RECORD_HEADER:], payload)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if int64(len(record)) > s.cfg.MaxBytes {
+		return errSpoolFull
+	}
+	for s.bytes+int64(len(record)) > s.cfg.MaxBytes && len(s.segments) > 1 {
+		s.dropOldestSegment()
+	}
+	if s.bytes+int64(len(record)) > s.cfg.MaxBytes {
+		return errSpoolFull
+	}
+
+	if s.writer == nil || s.segments[len(s.segments)-1].size >= s.cfg.SegmentBytes {
+		if err = s.rollSegment(); nil != err {
+			return err
+		}
+	}
+	last := s.segments[len(s.segments)-1]
+	if _, err = s.writer.Write(record); nil != err {
+		// 截掉写了一半的记录
+		s.writer.Truncate(last.size)
+		return err
+	}
+	if err = s.writer.Sync(); nil != err {
+		return err
+	}
+	last.size += int64(len(record))
+	s.bytes += int64(len(record))
+	s.batches++
+	s.updateMetrics()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *diskSpool) rollSegment() error {
+	var id int64 = 1
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1].id + 1
+	}
+	fp, err := os.OpenFile(s.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if nil != err {
+		return err
+	}
+	if s.writer != nil {
+		s.writer.Close()
+	}
+	s.writer = fp
+	s.segments = append(s.segments, &spoolSegment{id: id})
+	if len(s.segments) == 1 {
+		s.ack = spoolPos{Segment: id}
+	}
+	return nil
+}
+
+// 超过大小上限时丢弃最旧的分段, 调用方需持有锁
+func (s *diskSpool) dropOldestSegment() {
+	seg := s.segments[0]
+	dropped := s.countRecords(seg.id, s.startOffset(seg.id))
+	clog.Logger.Warning("spool exceeds %d bytes, drop segment %d with %d batches", s.cfg.MaxBytes, seg.id, dropped)
+
+	s.bytes -= seg.size - s.startOffset(seg.id)
+	s.batches -= dropped
+	s.droppedCount.Inc(dropped)
+	os.Remove(s.segmentPath(seg.id))
+	s.segments = s.segments[1:]
+	s.ack = spoolPos{Segment: s.segments[0].id}
+	s.saveAck()
+}
+
+// Peek 读取ack位置的下一条记录, 没有数据时返回nil
+// 返回的位置在发送成功后传给Ack
+func (s *diskSpool) Peek() (*spoolBatch, spoolPos, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for {
+		if len(s.segments) == 0 || s.batches == 0 {
+			return nil, s.ack, nil
+		}
+		seg := s.segments[0]
+		if s.ack.Offset >= seg.size {
+			if len(s.segments) == 1 {
+				return nil, s.ack, nil
+			}
+			// 当前分段已经读完
+			os.Remove(s.segmentPath(seg.id))
+			s.segments = s.segments[1:]
+			s.ack = spoolPos{Segment: s.segments[0].id}
+			s.saveAck()
+			s.updateMetrics()
+			continue
+		}
+
+		payload, err := s.readAt(seg.id, s.ack.Offset)
+		if nil != err {
+			// 分段损坏, 跳过剩下的部分
+			clog.Logger.Error("read spool segment %d at %d err: %v, skip it", seg.id, s.ack.Offset, err)
+			s.skip(seg.size - s.ack.Offset)
+			continue
+		}
+		next := spoolPos{Segment: seg.id, Offset: s.ack.Offset + int64(SPOOL_RECORD_HEADER+len(payload))}
+
+		var b spoolBatch
+		if err = json.Unmarshal(payload, &b); nil != err {
+			clog.Logger.Error("decode spool batch err: %v, skip it", err)
+			s.advance(next)
+			continue
+		}
+		if s.maxAge > 0 && time.Since(time.Unix(b.Time, 0)) > s.maxAge {
+			clog.Logger.Warning("spool batch of file: %s expired, drop it", b.Report.FileName)
+			s.droppedCount.Inc(1)
+			s.advance(next)
+			continue
+		}
+		return &b, next, nil
+	}
+}
+
+func (s *diskSpool) readAt(id, offset int64) ([]byte, error) {
+	fp, err := os.Open(s.segmentPath(id))
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+	if _, err = fp.Seek(offset, io.SeekStart); nil != err {
+		return nil, err
+	}
+	return readSpoolRecord(bufio.NewReader(fp))
+}
+
+// Ack 记录已经发送成功
+func (s *diskSpool) Ack(pos spoolPos) {
+	s.Lock()
+	defer s.Unlock()
+	if pos.Segment != s.ack.Segment || pos.Offset <= s.ack.Offset {
+		return
+	}
+	s.advance(pos)
+}
+
+// 调用方需持有锁
+func (s *diskSpool) advance(pos spoolPos) {
+	s.bytes -= pos.Offset - s.ack.Offset
+	s.batches--
+	s.ack = pos
+	s.saveAck()
+	s.updateMetrics()
+}
+
+// 跳过损坏的数据, 重新统计剩下的batch数, 调用方需持有锁
+func (s *diskSpool) skip(n int64) {
+	s.bytes -= n
+	s.ack.Offset += n
+	s.batches = 0
+	for _, seg := range s.segments {
+		s.batches += s.countRecords(seg.id, s.startOffset(seg.id))
+	}
+	s.saveAck()
+	s.updateMetrics()
+}
+
+// 和进度文件一样先写临时文件并fsync再rename, 中途崩溃不会留下半个ack
+func (s *diskSpool) saveAck() {
+	buf, _ := json.Marshal(&s.ack)
+	if err := writeFileAtomic(filepath.Join(s.cfg.Dir, SPOOL_ACK_FILE), buf); nil != err {
+		clog.Logger.Error("save spool ack err: %v", err)
+	}
+}
+
+func (s *diskSpool) updateMetrics() {
+	s.bytesGauge.Update(s.bytes)
+	s.batchesGauge.Update(s.batches)
+	s.segmentsGauge.Update(int64(len(s.segments)))
+}
+
+// Replay 服务端恢复后按顺序重发落盘的数据
+func (s *diskSpool) Replay() {
+	tick := time.NewTicker(SPOOL_RETRY_INTERVAL)
+	defer tick.Stop()
+
+	var failures int
+	for {
+		b, pos, err := s.Peek()
+		if nil != err {
+			clog.Logger.Error("peek spool err: %v", err)
+		}
+		if b == nil || nil != err {
+			select {
+			case <-s.notify:
+			case <-tick.C:
+			}
+			continue
+		}
+
+		gThrottle.Wait(len(b.Report.LogInfo))
+		_, err = gReporter.Send(b.Url, &b.Report)
+		if err == errReportRejected {
+			// 服务端不接受的数据重发也不会成功, 丢掉避免堵住后面的数据
+			clog.Logger.Error("spooled file: %s rejected by server, drop it", b.Report.FileName)
+			s.droppedCount.Inc(1)
+		} else if _, ok := err.(*offsetConflictError); ok {
+			// 采集进度已经越过这条数据, 由后续上报按服务端的位置对齐
+			clog.Logger.Warning("spooled file: %s %v, drop it", b.Report.FileName, err)
+		} else if nil != err {
+			clog.Logger.Error("replay spooled file: %s err: %v", b.Report.FileName, err)
+			time.Sleep(gReporter.Backoff(failures))
+			failures++
+			continue
+		}
+		if nil == err {
+			gReporter.sentCount.Inc(int64(len(b.Report.LogInfo)))
+		}
+		failures = 0
+		s.Ack(pos)
+	}
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"backend/common/clog"
+	"github.com/zh4af/loggather/protocol"
+)
+
+const (
+	TRANSPORT_HTTP = "http"
+	TRANSPORT_TCP  = "tcp"
+
+	STREAM_KEEPALIVE = time.Second * 30 // ping间隔, 3次没有收到任何帧认为连接已断
+)
+
+var errStreamClosed = errors.New("stream conn closed")
+
+// streamConn 到一台服务端的长连接, 多个文件的上报共用, 按帧id等待各自的确认
+type streamConn struct {
+	addr    string
+	conn    net.Conn
+	timeout time.Duration
+	wlock   sync.Mutex
+
+	sync.Mutex
+	next     uint64
+	pending  map[uint64]chan *protocol.StreamAck
+	lastRecv time.Time
+	draining bool // 服务端发了GOAWAY, 等已发出的上报确认完后关闭
+	closed   bool
+	done     chan struct{}
+}
+
+// streamPool 每台服务端一个长连接, 断开或者服务端要求换连接时, 下次发送重新连接
+type streamPool struct {
+	timeout time.Duration
+
+	sync.Mutex
+	conns map[string]*streamConn
+}
+
+func newStreamPool(timeout time.Duration) *streamPool {
+	return &streamPool{timeout: timeout, conns: make(map[string]*streamConn, 1)}
+}
+
+func (p *streamPool) get(addr string) (*streamConn, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if c := p.conns[addr]; c != nil && c.usable() {
+		return c, nil
+	}
+	c, err := dialStream(addr, p.timeout)
+	if nil != err {
+		return nil, err
+	}
+	p.conns[addr] = c
+	return c, nil
+}
+
+// Post 通过长连接发送一次上报并等待确认, 返回服务端确认的源文件位置
+func (p *streamPool) Post(addr string, body *protocol.LogGatherReport) (int64, error) {
+	ack, err := p.roundTrip(addr, protocol.FRAME_REPORT, body)
+	if nil != err {
+		return 0, err
+	}
+	result := protocol.LogGatherResult{Code: ack.Code, Msg: ack.Msg}
+	if len(ack.Results) == 1 {
+		result = ack.Results[0]
+	}
+	r := resultAck(body, result)
+	return r.committed, r.err
+}
+
+// PostBatch 通过长连接发送批量上报, 返回逐条的结果
+func (p *streamPool) PostBatch(addr string, bodies []*protocol.LogGatherReport) ([]reportAck, error) {
+	ack, err := p.roundTrip(addr, protocol.FRAME_BATCH, newBatch(bodies))
+	if nil != err {
+		return nil, err
+	}
+	if ack.Code >= 400 && ack.Code < 500 {
+		clog.Logger.Error("report batch of %d stream ack: %d %s", len(bodies), ack.Code, ack.Msg)
+		return nil, errReportRejected
+	}
+	if ack.Code != 200 {
+		return nil, fmt.Errorf("stream ack: %d %s", ack.Code, ack.Msg)
+	}
+	return batchResults(bodies, ack.Results)
+}
+
+// Heartbeat 通过长连接发送心跳, 旧版本服务端不认识心跳帧, 等到超时返回错误
+func (p *streamPool) Heartbeat(addr string, hb *protocol.Heartbeat) error {
+	ack, err := p.roundTrip(addr, protocol.FRAME_HEARTBEAT, hb)
+	if nil != err {
+		return err
+	}
+	if ack.Code != 200 {
+		return fmt.Errorf("heartbeat stream ack: %d %s", ack.Code, ack.Msg)
+	}
+	return nil
+}
+
+func (p *streamPool) roundTrip(addr string, frame_type byte, v interface{}) (*protocol.StreamAck, error) {
+	payload, err := protocol.EncodeMsgpack(v)
+	if nil != err {
+		return nil, err
+	}
+	c, err := p.get(addr)
+	if nil != err {
+		return nil, err
+	}
+	return c.request(frame_type, payload)
+}
+
+func dialStream(addr string, timeout time.Duration) (*streamConn, error) {
+	dialer := net.Dialer{Timeout: timeout, KeepAlive: STREAM_KEEPALIVE}
+	conn, err := dialer.Dial("tcp", addr)
+	if nil != err {
+		return nil, err
+	}
+	c := &streamConn{
+		addr:     addr,
+		conn:     conn,
+		timeout:  timeout,
+		pending:  make(map[uint64]chan *protocol.StreamAck, 1),
+		lastRecv: time.Now(),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.keepalive()
+	clog.Logger.Info("stream conn to %s established", addr)
+	return c, nil
+}
+
+func (c *streamConn) usable() bool {
+	c.Lock()
+	defer c.Unlock()
+	return !c.closed && !c.draining
+}
+
+func (c *streamConn) request(frame_type byte, payload []byte) (*protocol.StreamAck, error) {
+	ch := make(chan *protocol.StreamAck, 1)
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil, errStreamClosed
+	}
+	c.next++
+	id := c.next
+	c.pending[id] = ch
+	c.Unlock()
+
+	if err := c.write(&protocol.Frame{Type: frame_type, Id: id, Payload: payload}); nil != err {
+		c.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case ack := <-ch:
+		return ack, nil
+	case <-c.done:
+		return nil, errStreamClosed
+	case <-timer.C:
+		c.Lock()
+		delete(c.pending, id)
+		c.Unlock()
+		return nil, fmt.Errorf("stream ack from %s timeout", c.addr)
+	}
+}
+
+func (c *streamConn) write(f *protocol.Frame) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return protocol.WriteFrame(c.conn, f)
+}
+
+func (c *streamConn) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		f, err := protocol.ReadFrame(r)
+		if nil != err {
+			c.close(err)
+			return
+		}
+
+		c.Lock()
+		c.lastRecv = time.Now()
+		switch f.Type {
+		case protocol.FRAME_ACK:
+			if ch, ok := c.pending[f.Id]; ok {
+				delete(c.pending, f.Id)
+				var ack protocol.StreamAck
+				if err = protocol.DecodeMsgpack(f.Payload, &ack); nil != err {
+					ack = protocol.StreamAck{Code: 500, Msg: err.Error()}
+				}
+				ch <- &ack
+			}
+		case protocol.FRAME_GOAWAY:
+			clog.Logger.Info("stream conn to %s receive goaway", c.addr)
+			c.draining = true
+		}
+		drained := c.draining && len(c.pending) == 0
+		c.Unlock()
+
+		if drained {
+			c.close(nil)
+			return
+		}
+	}
+}
+
+func (c *streamConn) keepalive() {
+	tick := time.NewTicker(STREAM_KEEPALIVE)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tick.C:
+		}
+
+		c.Lock()
+		idle := time.Since(c.lastRecv)
+		c.Unlock()
+		if idle > 3*STREAM_KEEPALIVE {
+			c.close(fmt.Errorf("no frame for %v", idle))
+			return
+		}
+		if err := c.write(&protocol.Frame{Type: protocol.FRAME_PING}); nil != err {
+			c.close(err)
+			return
+		}
+	}
+}
+
+// 关闭连接, 还在等待确认的上报返回错误, 由上层重试
+func (c *streamConn) close(err error) {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return
+	}
+	c.closed = true
+	c.pending = nil
+	c.Unlock()
+
+	close(c.done)
+	c.conn.Close()
+	if nil != err {
+		clog.Logger.Warning("stream conn to %s closed: %v", c.addr, err)
+	}
+}
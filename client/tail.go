@@ -0,0 +1,333 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"backend/common/clog"
+)
+
+const (
+	ROTATE_DRAIN_GRACE = time.Second * 30 // 被轮转的文件读完后再等一段时间, 防止写入方还没切换到新文件
+)
+
+var errNotRegular = errors.New("not a regular file")
+var errTailDrained = errors.New("rotated file already drained")
+
+// tailFile 正在采集的文件, 一直保持打开, 这样文件被改名或删除后仍能读完剩余内容
+type tailFile struct {
+	key        string // dev:ino
+	fp         *os.File
+	lastRead   time.Time
+	lastSize   int64
+	lastGrow   time.Time // 文件最近一次变大的时间
+	flushTimer int32     // 已经安排了多行事件的超时发送
+	backlog    int64     // 最近一次采集时还没有读的字节数
+}
+
+var gTails = struct {
+	sync.Mutex
+	files map[string]*tailFile // key: dev:ino
+}{files: make(map[string]*tailFile, 1)}
+
+// 打开(或找到已打开的)文件, name为文件相对输入根目录的路径
+// 返回上报使用的文件名和文件key
+func openTail(in *gatherInput, path, name string) (string, string, error) {
+	fi, err := os.Stat(path)
+	if nil != err {
+		return "", "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", "", errNotRegular
+	}
+
+	gTails.Lock()
+	defer gTails.Unlock()
+	key := fileKey(fileIdentity(path, fi))
+	if _, ok := gTails.files[key]; ok {
+		return touchRecord(key, path, name), key, nil
+	}
+
+	fp, err := os.Open(path)
+	if nil != err {
+		return "", "", err
+	}
+	// 以打开后的fd为准, 防止stat和open之间文件被替换
+	if fi, err = fp.Stat(); nil != err {
+		fp.Close()
+		return "", "", err
+	}
+	dev, ino := fileIdentity(path, fi)
+	key = fileKey(dev, ino)
+	if _, ok := gTails.files[key]; ok {
+		fp.Close()
+		return touchRecord(key, path, name), key, nil
+	}
+
+	gRecordInfo.Lock()
+	rec := gRecordInfo.Data[key]
+	if rec != nil {
+		same, err := verifyFingerprint(fp, rec, fi.Size())
+		if nil != err {
+			gRecordInfo.Unlock()
+			fp.Close()
+			return "", "", err
+		}
+		if !same {
+			clog.Logger.Warning("file: %s inode %s reused by new content, read from start", path, key)
+			rec = nil
+		} else if rec.Drained {
+			if fi.Size() <= rec.Offset {
+				gRecordInfo.Unlock()
+				fp.Close()
+				return rec.Name, key, errTailDrained
+			}
+			rec.Drained = false
+		}
+	}
+	if rec == nil {
+		rec = &FileRecord{Input: in.Name, Name: name, Dev: dev, Ino: ino}
+		if offset, ok := gLegacyOffsets[name]; ok {
+			if int64(offset) <= fi.Size() {
+				rec.Offset = int64(offset)
+			}
+			delete(gLegacyOffsets, name)
+		}
+		verifyFingerprint(fp, rec, fi.Size())
+		gRecordInfo.Data[key] = rec
+	}
+	gRecordInfo.Unlock()
+
+	gTails.files[key] = &tailFile{key: key, fp: fp, lastRead: time.Now(), lastSize: fi.Size(), lastGrow: time.Now()}
+	return touchRecord(key, path, name), key, nil
+}
+
+// 更新文件当前路径, 文件名和上报名不一致说明已被改名
+func touchRecord(key, path, name string) string {
+	gRecordInfo.Lock()
+	defer gRecordInfo.Unlock()
+
+	rec := gRecordInfo.Data[key]
+	if rec == nil {
+		return name
+	}
+	rec.Path = path
+	if rec.Name != name && !rec.Rotated {
+		clog.Logger.Info("file: %s renamed to %s", rec.Name, path)
+		rec.Rotated = true
+	}
+	return rec.Name
+}
+
+// 所有打开的文件还没有读的字节数, 加上落盘还没有重发的数据
+func totalBacklog() int64 {
+	var total int64
+	gTails.Lock()
+	for _, t := range gTails.files {
+		total += atomic.LoadInt64(&t.backlog)
+	}
+	gTails.Unlock()
+	if gSpool != nil {
+		total += gSpool.Backlog()
+	}
+	return total
+}
+
+// 采集流中所有文件还没有读的字节数
+func streamBacklog(input, name string) int64 {
+	var total int64
+	gTails.Lock()
+	gRecordInfo.Lock()
+	for key, t := range gTails.files {
+		rec := gRecordInfo.Data[key]
+		if rec == nil || rec.Input != input || rec.Name != name {
+			continue
+		}
+		total += tailLag(t, rec)
+	}
+	gRecordInfo.Unlock()
+	gTails.Unlock()
+	return total
+}
+
+// 所有打开的采集流的积压, 文件当前大小减去采集进度, 轮转出去还没读完的文件算在同名的流中
+func streamLags() map[streamKey]int64 {
+	lags := make(map[streamKey]int64)
+	gTails.Lock()
+	gRecordInfo.Lock()
+	for key, t := range gTails.files {
+		if rec := gRecordInfo.Data[key]; rec != nil {
+			lags[streamKey{input: rec.Input, name: rec.Name}] += tailLag(t, rec)
+		}
+	}
+	gRecordInfo.Unlock()
+	gTails.Unlock()
+	return lags
+}
+
+// 调用方需持有gTails和gRecordInfo的锁
+func tailLag(t *tailFile, rec *FileRecord) int64 {
+	if fi, err := t.fp.Stat(); nil == err && fi.Size() > rec.Offset {
+		return fi.Size() - rec.Offset
+	}
+	return 0
+}
+
+// path被改名或删除, 对应的文件标记为轮转
+// 返回受影响的采集流
+func markRotatedPath(path string) []streamKey {
+	var cur_key string
+	if fi, err := os.Stat(path); nil == err {
+		// path上已经是新文件了
+		cur_key = fileKey(fileIdentity(path, fi))
+	}
+
+	var streams []streamKey
+	gTails.Lock()
+	gRecordInfo.Lock()
+	for key := range gTails.files {
+		rec := gRecordInfo.Data[key]
+		if rec == nil || rec.Path != path || key == cur_key {
+			continue
+		}
+		rec.Rotated = true
+		streams = append(streams, streamKey{input: rec.Input, name: rec.Name})
+	}
+	gRecordInfo.Unlock()
+	gTails.Unlock()
+
+	return streams
+}
+
+// 输入全量扫描后, 没有出现的文件已经被移出采集目录
+// 返回所有未出现文件的上报名, 需要继续采集把它们读完
+func markUnseenTails(input string, seen map[string]bool) []string {
+	var names []string
+	gTails.Lock()
+	gRecordInfo.Lock()
+	for key := range gTails.files {
+		if seen[key] {
+			continue
+		}
+		if rec := gRecordInfo.Data[key]; rec != nil && rec.Input == input {
+			rec.Rotated = true
+			names = append(names, rec.Name)
+		}
+	}
+	// 没有打开也没有出现的记录对应的文件已经不存在了
+	for key, rec := range gRecordInfo.Data {
+		if _, ok := gTails.files[key]; !ok && !seen[key] && rec.Input == input {
+			delete(gRecordInfo.Data, key)
+		}
+	}
+	gRecordInfo.Unlock()
+	gTails.Unlock()
+
+	return names
+}
+
+// 输入下上报名为name的所有文件, 轮转出去的旧文件排在前面, 保证按顺序上报
+func tailsByName(input, name string) []*tailFile {
+	type sortTail struct {
+		tail    *tailFile
+		rotated bool
+		modTime time.Time
+	}
+	var list []sortTail
+
+	gTails.Lock()
+	gRecordInfo.Lock()
+	for key, t := range gTails.files {
+		rec := gRecordInfo.Data[key]
+		if rec == nil || rec.Input != input || rec.Name != name {
+			continue
+		}
+		st := sortTail{tail: t, rotated: rec.Rotated}
+		if fi, err := t.fp.Stat(); nil == err {
+			st.modTime = fi.ModTime()
+		}
+		list = append(list, st)
+	}
+	gRecordInfo.Unlock()
+	gTails.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].rotated != list[j].rotated {
+			return list[i].rotated
+		}
+		return list[i].modTime.Before(list[j].modTime)
+	})
+	tails := make([]*tailFile, len(list))
+	for i := range list {
+		tails[i] = list[i].tail
+	}
+	return tails
+}
+
+// 记录保留到文件从目录中消失, 防止留在目录中的旧文件被当成新文件重新采集
+func closeTail(t *tailFile) {
+	gTails.Lock()
+	delete(gTails.files, t.key)
+	gRecordInfo.Lock()
+	if rec := gRecordInfo.Data[t.key]; rec != nil {
+		rec.Drained = true
+	}
+	gRecordInfo.Unlock()
+	gTails.Unlock()
+
+	t.fp.Close()
+}
+
+// 检查文件是否被截断(copytruncate)或者内容被替换, 返回本次应该开始读取的位置
+// done为true表示轮转的文件已经读完, 可以关闭
+func prepareTail(t *tailFile) (name, uid string, stpos int64, size int64, done bool, err error) {
+	fi, err := t.fp.Stat()
+	if nil != err {
+		return "", "", 0, 0, false, err
+	}
+	size = fi.Size()
+	if size != t.lastSize {
+		t.lastSize = size
+		t.lastGrow = time.Now()
+	}
+
+	gRecordInfo.Lock()
+	defer gRecordInfo.Unlock()
+	rec := gRecordInfo.Data[t.key]
+	if rec == nil {
+		return "", "", 0, 0, true, nil
+	}
+	// 旧版本的记录没有uid
+	if rec.Uid == "" {
+		rec.Uid = newFileUid()
+	}
+	if size < rec.Offset {
+		clog.Logger.Warning("file: %s truncated from %d to %d, read from start", rec.Path, rec.Offset, size)
+		resetRecord(rec)
+	}
+	same, err := verifyFingerprint(t.fp, rec, size)
+	if nil != err {
+		return "", "", 0, 0, false, err
+	}
+	if !same {
+		clog.Logger.Warning("file: %s content replaced, read from start", rec.Path)
+		resetRecord(rec)
+		verifyFingerprint(t.fp, rec, size)
+	}
+
+	done = rec.Rotated && rec.Offset >= size && time.Since(t.lastRead) > ROTATE_DRAIN_GRACE
+	return rec.Name, rec.Uid, rec.Offset, size, done, nil
+}
+
+func commitTail(t *tailFile, offset int64) {
+	gRecordInfo.Lock()
+	if rec := gRecordInfo.Data[t.key]; rec != nil {
+		rec.Offset = offset
+	}
+	gRecordInfo.Unlock()
+	t.lastRead = time.Now()
+}
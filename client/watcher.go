@@ -0,0 +1,296 @@
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"backend/common/clog"
+)
+
+// FileOp 文件变化事件类型
+type FileOp uint32
+
+const (
+	FileCreate FileOp = 1 << iota
+	FileWrite
+	FileRename
+	FileRemove
+)
+
+const (
+	WATCH_MODE_AUTO    = "auto"    // 优先inotify, 不支持的目录(如NFS)自动退化为轮询
+	WATCH_MODE_INOTIFY = "inotify" // 只用inotify, 不支持inotify时启动失败
+	WATCH_MODE_POLL    = "poll"    // 只用轮询
+
+	DEFAULT_POLL_INTERVAL = time.Second * 10
+	WATCH_EVENT_BUF_SIZE  = 1024
+)
+
+// inotify队列溢出, 事件可能有丢失, 调用方需要全量扫描一次
+var ErrWatchOverflow = errors.New("watch event queue overflow")
+
+// inotify读取出错, 已经改为轮询, 期间的事件可能有丢失, 调用方需要全量扫描一次
+var ErrWatchFallback = errors.New("inotify failed, fall back to polling")
+
+type FileEvent struct {
+	Name  string // 文件完整路径
+	Op    FileOp
+	IsDir bool // 子目录的事件
+}
+
+type FileWatcher interface {
+	Add(dir string) error
+	Events() <-chan FileEvent
+	Errors() <-chan error
+	Close() error
+}
+
+// dirNotifier 由各平台实现(linux下为inotify)
+// 读取事件出错时停止监听, 把已经监听的目录交给fallback
+type dirNotifier interface {
+	Add(dir string) error
+	Close() error
+}
+
+// fileWatcher 按目录选择inotify或者轮询, 两者的事件汇总到同一个channel
+type fileWatcher struct {
+	mode   string
+	poller *pollWatcher
+	events chan FileEvent
+	errors chan error
+
+	sync.Mutex
+	notifier dirNotifier
+}
+
+// mode: auto/inotify/poll, 为空时按auto处理
+// interval: 轮询间隔
+func NewFileWatcher(mode string, interval time.Duration) (FileWatcher, error) {
+	var err error
+
+	if mode == "" {
+		mode = WATCH_MODE_AUTO
+	}
+	if mode != WATCH_MODE_AUTO && mode != WATCH_MODE_INOTIFY && mode != WATCH_MODE_POLL {
+		return nil, errors.New("unknown watch mode: " + mode)
+	}
+	if interval <= 0 {
+		interval = DEFAULT_POLL_INTERVAL
+	}
+
+	w := &fileWatcher{
+		mode:   mode,
+		events: make(chan FileEvent, WATCH_EVENT_BUF_SIZE),
+		errors: make(chan error, 16),
+	}
+	w.poller = newPollWatcher(interval, w.events, w.errors)
+	if mode != WATCH_MODE_POLL {
+		w.notifier, err = newDirNotifier(w.events, w.errors, w.fallback)
+		if nil != err {
+			if mode == WATCH_MODE_INOTIFY {
+				return nil, err
+			}
+			clog.Logger.Warning("init inotify err: %v, fall back to polling", err)
+			w.notifier = nil
+		}
+	}
+
+	return w, nil
+}
+
+// inotify模式下不退化为轮询, 监听失败直接返回错误
+func (w *fileWatcher) Add(dir string) error {
+	w.Lock()
+	notifier := w.notifier
+	w.Unlock()
+
+	if notifier != nil {
+		if w.mode == WATCH_MODE_INOTIFY {
+			return notifier.Add(dir)
+		}
+		if isNetworkFS(dir) {
+			clog.Logger.Info("dir %s is on network filesystem, use polling", dir)
+		} else if err := notifier.Add(dir); nil != err {
+			clog.Logger.Warning("inotify watch dir %s err: %v, fall back to polling", dir, err)
+		} else {
+			return nil
+		}
+	}
+
+	return w.poller.Add(dir)
+}
+
+// inotify读取事件出错后, 所有目录改为轮询, 之后新加的目录也直接轮询
+func (w *fileWatcher) fallback(dirs []string) {
+	w.Lock()
+	w.notifier = nil
+	w.Unlock()
+
+	for _, dir := range dirs {
+		if err := w.poller.Add(dir); nil != err {
+			clog.Logger.Warning("poll dir %s err: %v", dir, err)
+		}
+	}
+	select {
+	case w.errors <- ErrWatchFallback:
+	default:
+	}
+}
+
+func (w *fileWatcher) Events() <-chan FileEvent {
+	return w.events
+}
+
+func (w *fileWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *fileWatcher) Close() error {
+	var err error
+	w.Lock()
+	if w.notifier != nil {
+		err = w.notifier.Close()
+	}
+	w.Unlock()
+	w.poller.Close()
+	return err
+}
+
+type pollFileStat struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// pollWatcher 定时扫描目录, 比较文件大小和修改时间生成事件
+type pollWatcher struct {
+	sync.Mutex
+	dirs     map[string]map[string]pollFileStat // dir -> (path -> stat)
+	interval time.Duration
+	events   chan<- FileEvent
+	errors   chan<- error
+	done     chan struct{}
+	once     sync.Once
+	started  bool
+}
+
+func newPollWatcher(interval time.Duration, events chan<- FileEvent, errs chan<- error) *pollWatcher {
+	return &pollWatcher{
+		dirs:     make(map[string]map[string]pollFileStat, 1),
+		interval: interval,
+		events:   events,
+		errors:   errs,
+		done:     make(chan struct{}),
+	}
+}
+
+func (p *pollWatcher) Add(dir string) error {
+	if _, err := os.Stat(dir); nil != err {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.dirs[dir]; !ok {
+		// 首次扫描只记录状态不产生事件, 已有文件由调用方的全量扫描处理
+		cur, _, err := scanPollDir(dir, nil)
+		if nil != err {
+			return err
+		}
+		p.dirs[dir] = cur
+	}
+	if !p.started {
+		p.started = true
+		go p.run()
+	}
+	return nil
+}
+
+func (p *pollWatcher) Close() {
+	p.once.Do(func() { close(p.done) })
+}
+
+// 持有锁时只扫描和收集事件, 解锁后再发送; 发送会阻塞到调用方取走, 调用方处理事件时可能正在Add
+func (p *pollWatcher) run() {
+	tick := time.NewTicker(p.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-tick.C:
+			var events []FileEvent
+			var errs []error
+			p.Lock()
+			for dir, last := range p.dirs {
+				cur, evs, err := scanPollDir(dir, last)
+				if nil != err {
+					errs = append(errs, err)
+					continue
+				}
+				p.dirs[dir] = cur
+				events = append(events, evs...)
+			}
+			p.Unlock()
+
+			for _, err := range errs {
+				p.sendErr(err)
+			}
+			for _, ev := range events {
+				p.send(ev)
+			}
+		}
+	}
+}
+
+// 返回目录的当前状态和相对last的变化, last为nil时没有事件
+func scanPollDir(dir string, last map[string]pollFileStat) (map[string]pollFileStat, []FileEvent, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	var events []FileEvent
+	cur := make(map[string]pollFileStat, len(infos))
+	for _, info := range infos {
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		st := pollFileStat{size: info.Size(), modTime: info.ModTime(), isDir: info.IsDir()}
+		cur[path] = st
+		if last == nil {
+			continue
+		}
+		if old, ok := last[path]; !ok {
+			events = append(events, FileEvent{Name: path, Op: FileCreate, IsDir: st.isDir})
+		} else if !st.isDir && (old.size != st.size || !old.modTime.Equal(st.modTime)) {
+			events = append(events, FileEvent{Name: path, Op: FileWrite})
+		}
+	}
+	for path, st := range last {
+		if _, ok := cur[path]; !ok {
+			events = append(events, FileEvent{Name: path, Op: FileRemove, IsDir: st.isDir})
+		}
+	}
+	return cur, events, nil
+}
+
+func (p *pollWatcher) send(ev FileEvent) {
+	select {
+	case p.events <- ev:
+	case <-p.done:
+	}
+}
+
+func (p *pollWatcher) sendErr(err error) {
+	select {
+	case p.errors <- err:
+	default:
+	}
+}
@@ -0,0 +1,185 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"backend/common/clog"
+)
+
+const (
+	INOTIFY_WATCH_MASK = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE |
+		syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+	NFS_SUPER_MAGIC  = 0x6969
+	SMB_SUPER_MAGIC  = 0x517B
+	CIFS_MAGIC       = 0xFF534D42
+	FUSE_SUPER_MAGIC = 0x65735546
+)
+
+// inotifyNotifier 通过inotify监听目录下文件的变化
+type inotifyNotifier struct {
+	sync.Mutex
+	fd       int
+	file     *os.File
+	watches  map[int]string // wd -> dir
+	dirs     map[string]int // dir -> wd
+	events   chan<- FileEvent
+	errors   chan<- error
+	fallback func(dirs []string)
+}
+
+func newDirNotifier(events chan<- FileEvent, errs chan<- error, fallback func(dirs []string)) (dirNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if nil != err {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	n := &inotifyNotifier{
+		fd: fd,
+		// 非阻塞fd交给runtime poller, Close时可以唤醒阻塞中的Read
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		watches:  make(map[int]string, 1),
+		dirs:     make(map[string]int, 1),
+		events:   events,
+		errors:   errs,
+		fallback: fallback,
+	}
+	go n.readEvents()
+
+	return n, nil
+}
+
+func (n *inotifyNotifier) Add(dir string) error {
+	dir = filepath.Clean(dir)
+
+	n.Lock()
+	defer n.Unlock()
+	if _, ok := n.dirs[dir]; ok {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, INOTIFY_WATCH_MASK)
+	if nil != err {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	n.watches[wd] = dir
+	n.dirs[dir] = wd
+
+	return nil
+}
+
+func (n *inotifyNotifier) Close() error {
+	return n.file.Close()
+}
+
+func (n *inotifyNotifier) readEvents() {
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+
+	for {
+		rn, err := n.file.Read(buf[:])
+		if nil != err {
+			if pe, ok := err.(*os.PathError); ok && pe.Err == os.ErrClosed {
+				return
+			}
+			clog.Logger.Error("read inotify event err: %v, fall back to polling", err)
+			n.stop()
+			return
+		}
+		if rn < syscall.SizeofInotifyEvent {
+			continue
+		}
+
+		var offset int
+		for offset <= rn-syscall.SizeofInotifyEvent {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name_len := int(raw.Len)
+			var name string
+			if name_len > 0 {
+				name_bytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+name_len]
+				name = string(trimNul(name_bytes))
+			}
+			offset += syscall.SizeofInotifyEvent + name_len
+
+			n.handleEvent(int(raw.Wd), raw.Mask, name)
+		}
+	}
+}
+
+// 关闭inotify, 已经监听的目录交给轮询
+func (n *inotifyNotifier) stop() {
+	n.Lock()
+	dirs := make([]string, 0, len(n.dirs))
+	for dir := range n.dirs {
+		dirs = append(dirs, dir)
+	}
+	n.Unlock()
+	n.file.Close()
+	n.fallback(dirs)
+}
+
+func (n *inotifyNotifier) handleEvent(wd int, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		select {
+		case n.errors <- ErrWatchOverflow:
+		default:
+		}
+		return
+	}
+
+	n.Lock()
+	dir, ok := n.watches[wd]
+	if ok && mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF|syscall.IN_IGNORED) != 0 {
+		// 目录本身被删除或者移走, 内核会自动移除watch
+		delete(n.watches, wd)
+		delete(n.dirs, dir)
+		clog.Logger.Warning("watched dir %s is gone", dir)
+	}
+	n.Unlock()
+	if !ok || name == "" {
+		return
+	}
+
+	ev := FileEvent{Name: filepath.Join(dir, name), IsDir: mask&syscall.IN_ISDIR != 0}
+	switch {
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		ev.Op = FileCreate
+	case mask&(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE) != 0:
+		ev.Op = FileWrite
+	case mask&syscall.IN_MOVED_FROM != 0:
+		ev.Op = FileRename
+	case mask&syscall.IN_DELETE != 0:
+		ev.Op = FileRemove
+	default:
+		return
+	}
+	n.events <- ev
+}
+
+func trimNul(b []byte) []byte {
+	for i := range b {
+		if b[i] == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+// inotify在网络文件系统上收不到其他主机写入的事件
+func isNetworkFS(dir string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); nil != err {
+		return false
+	}
+	switch uint32(st.Type) {
+	case NFS_SUPER_MAGIC, SMB_SUPER_MAGIC, CIFS_MAGIC, FUSE_SUPER_MAGIC:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import "errors"
+
+var errWatchUnsupported = errors.New("inotify is not supported on this platform")
+
+func newDirNotifier(events chan<- FileEvent, errs chan<- error, fallback func(dirs []string)) (dirNotifier, error) {
+	return nil, errWatchUnsupported
+}
+
+func isNetworkFS(dir string) bool {
+	return false
+}
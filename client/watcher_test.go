@@ -0,0 +1,54 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 事件没有被取走时, 轮询协程阻塞在发送上也不能占着锁, 调用方处理事件时还要Add新目录
+func TestPollWatcherAddWhileSending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loggather")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	if err = os.Mkdir(sub, 0755); nil != err {
+		t.Fatal(err)
+	}
+
+	events := make(chan FileEvent)
+	p := newPollWatcher(10*time.Millisecond, events, make(chan error, 1))
+	defer p.Close()
+	if err = p.Add(dir); nil != err {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "app.log"), []byte("x\n"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	// 等轮询发现新文件并阻塞在发送上
+	time.Sleep(50 * time.Millisecond)
+
+	added := make(chan error, 1)
+	go func() { added <- p.Add(sub) }()
+	select {
+	case err = <-added:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Add blocked while an event is pending")
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Name != filepath.Join(dir, "app.log") || ev.Op != FileCreate {
+			t.Errorf("event %+v, want create app.log", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+}
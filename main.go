@@ -3,7 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
 	// "blast/common/util"
 	"backend/common/clog"
@@ -15,6 +19,8 @@ import (
 const DEFAULT_CONF_FILE = "./conf/loggather.conf"
 const (
 	SERVERNAME = "loggather"
+
+	STREAM_DRAIN_TIMEOUT = time.Second * 30
 )
 
 var EtcdHost string
@@ -23,7 +29,12 @@ var g_conf_file string = DEFAULT_CONF_FILE
 var g_actor_type string
 var g_cpupro_file string = ""
 var g_mempro_file string = ""
-var g_config config.Configure
+var g_config LogGatherConfig
+
+type LogGatherConfig struct {
+	config.Configure
+	client.ClientConfig
+}
 
 const (
 	ACTOR_TYPE_CLIENT = "client"
@@ -54,6 +65,7 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	config.Config = &g_config.Configure
 
 	//init log
 	_, err = clog.InitLogger(g_config.LogFile + g_actor_type)
@@ -64,11 +76,47 @@ func main() {
 
 	switch g_actor_type {
 	case ACTOR_TYPE_CLIENT:
-		client.RunLogClient()
+		go reloadOnSignal()
+		client.RunLogClient(&g_config.ClientConfig)
 	case ACTOR_TYPE_SERVER:
 		fallthrough
 	default:
 		// go util.RegisterSelfToConsul(g_config.Listen)
+		if g_config.RpcListen != "" {
+			if err = server.StartStreamServer(g_config.RpcListen); nil != err {
+				fmt.Println("start stream server error:", err)
+				return
+			}
+			go drainOnSignal()
+		}
 		server.StartHttpServer(g_config.Listen)
 	}
 }
+
+// 退出前让长连接上正在处理的上报写完
+func drainOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	clog.Logger.Info("receive signal %v, drain stream server", sig)
+	server.DrainStreamServer(STREAM_DRAIN_TIMEOUT)
+	os.Exit(0)
+}
+
+// 收到SIGHUP时重新读取配置文件, 目前只有上报带宽可以运行时修改
+func reloadOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		var cfg LogGatherConfig
+		if _, err := config.GetCfgFromEtcdOrFile(EtcdHost, g_conf_file, SERVERNAME, &cfg); nil != err {
+			clog.Logger.Error("reload config: %s err: %v", g_conf_file, err)
+			continue
+		}
+		if err := client.SetBandwidth(cfg.Bandwidth); nil != err {
+			clog.Logger.Error("reload bandwidth err: %v", err)
+			continue
+		}
+		clog.Logger.Info("reload config: %s", g_conf_file)
+	}
+}
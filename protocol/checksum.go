@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"errors"
+
+	"third/crc32"
+	"third/xxHash/xxHash32"
+)
+
+// 校验和按解压后的原始数据计算, 服务端解压后校验, 不一致时不写入
+const (
+	CHECKSUM_NONE     = "none"
+	CHECKSUM_CRC32C   = "crc32c" // 默认, 有硬件加速
+	CHECKSUM_XXHASH32 = "xxhash32"
+
+	CODE_CHECKSUM_MISMATCH = 422 // 客户端重发即可, 和其他4xx不同
+)
+
+var ErrUnknownChecksum = errors.New("unknown checksum")
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var gCastagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CheckChecksumAlgo 名字为空时不计算, 和旧版本一致
+func CheckChecksumAlgo(algo string) error {
+	switch algo {
+	case "", CHECKSUM_NONE, CHECKSUM_CRC32C, CHECKSUM_XXHASH32:
+		return nil
+	}
+	return ErrUnknownChecksum
+}
+
+func Checksum(algo string, data []byte) (uint32, error) {
+	switch algo {
+	case CHECKSUM_CRC32C:
+		return crc32.Checksum(data, gCastagnoliTable), nil
+	case CHECKSUM_XXHASH32:
+		return xxHash32.Checksum(data, 0), nil
+	}
+	return 0, ErrUnknownChecksum
+}
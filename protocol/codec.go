@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"third/lz4"
+	"third/snappy"
+)
+
+const (
+	CODEC_GZIP   = "gzip"
+	CODEC_SNAPPY = "snappy"
+	CODEC_LZ4    = "lz4"
+)
+
+var ErrUnknownCodec = errors.New("unknown codec")
+var ErrDecodedTooLarge = errors.New("decoded data too large")
+
+// Codec 上报数据的压缩方式, 名字随上报一起发送, 服务端按名字解压
+// Decode解压后超过limit字节时返回ErrDecodedTooLarge, 不会把整个数据读入内存, limit小于等于0不限制
+type Codec interface {
+	Name() string
+	Encode(dst *bytes.Buffer, src []byte) error
+	Decode(src []byte, limit int) ([]byte, error)
+}
+
+// NewCodec level只对gzip有效, 0表示默认级别
+// 名字为空时使用gzip, 和旧版本一致
+func NewCodec(name string, level int) (Codec, error) {
+	switch name {
+	case "", CODEC_GZIP:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, errors.New("bad gzip level")
+		}
+		return gzipCodec{level: level}, nil
+	case CODEC_SNAPPY:
+		return snappyCodec{}, nil
+	case CODEC_LZ4:
+		return lz4Codec{}, nil
+	}
+	return nil, ErrUnknownCodec
+}
+
+type gzipCodec struct {
+	level int
+}
+
+func (gzipCodec) Name() string {
+	return CODEC_GZIP
+}
+
+func (c gzipCodec) Encode(dst *bytes.Buffer, src []byte) error {
+	w, err := gzip.NewWriterLevel(dst, c.level)
+	if nil != err {
+		return err
+	}
+	if _, err = w.Write(src); nil != err {
+		return err
+	}
+	return w.Close()
+}
+
+func (gzipCodec) Decode(src []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if nil != err {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, limit)
+}
+
+// snappy使用block格式, 头部带原始长度, 单次上报不超过几百K, 不需要流式
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return CODEC_SNAPPY
+}
+
+func (snappyCodec) Encode(dst *bytes.Buffer, src []byte) error {
+	dst.Write(snappy.Encode(nil, src))
+	return nil
+}
+
+func (snappyCodec) Decode(src []byte, limit int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if nil != err {
+		return nil, err
+	}
+	if limit > 0 && n > limit {
+		return nil, ErrDecodedTooLarge
+	}
+	return snappy.Decode(nil, src)
+}
+
+// lz4使用frame格式, 自带长度和校验
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string {
+	return CODEC_LZ4
+}
+
+func (lz4Codec) Encode(dst *bytes.Buffer, src []byte) error {
+	w := lz4.NewWriter(dst)
+	if _, err := w.Write(src); nil != err {
+		return err
+	}
+	return w.Close()
+}
+
+func (lz4Codec) Decode(src []byte, limit int) ([]byte, error) {
+	return readLimited(lz4.NewReader(bytes.NewReader(src)), limit)
+}
+
+// 多读一个字节判断是否超出, 没有超出时读取的错误原样返回, 如没有结尾的gzip数据
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if len(out) > limit {
+		return nil, ErrDecodedTooLarge
+	}
+	return out, err
+}
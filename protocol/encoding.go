@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"errors"
+	"path"
+
+	"third/go-codec/codec"
+)
+
+// v1: JSON, 压缩数据base64后放在log_info字段
+// v2: 请求体直接是压缩数据, 文件名和压缩方式放在header中; 或者整个上报用msgpack编码
+const (
+	ENCODING_JSON    = "json"
+	ENCODING_BINARY  = "binary"
+	ENCODING_MSGPACK = "msgpack"
+
+	CONTENT_TYPE_JSON    = "application/json"
+	CONTENT_TYPE_BINARY  = "application/octet-stream"
+	CONTENT_TYPE_MSGPACK = "application/msgpack"
+
+	HEADER_FILE_NAME = "X-Loggather-File" // url path编码的文件名
+	HEADER_CODEC     = "X-Loggather-Codec"
+	HEADER_AGENT_ID  = "X-Loggather-Agent-Id"
+	HEADER_HOSTNAME  = "X-Loggather-Hostname"
+	HEADER_IP        = "X-Loggather-Ip"
+	HEADER_VERSION   = "X-Loggather-Version"
+	HEADER_FILE_ID   = "X-Loggather-File-Id"
+	HEADER_OFFSET    = "X-Loggather-Offset"
+	HEADER_END       = "X-Loggather-End"
+	HEADER_CHECKSUM  = "X-Loggather-Checksum" // 算法:十进制校验和, 如 crc32c:12345
+
+	MAX_REPORT_BODY   = 64 * 1024 * 1024 // 单次上报请求体上限
+	MAX_BATCH_ENTRIES = 1000             // 单次批量上报最多条数
+)
+
+var ErrUnknownEncoding = errors.New("unknown encoding")
+
+var gMsgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+func EncodeMsgpack(v interface{}) ([]byte, error) {
+	var out []byte
+	err := codec.NewEncoderBytes(&out, gMsgpackHandle).Encode(v)
+	return out, err
+}
+
+func DecodeMsgpack(in []byte, v interface{}) error {
+	return codec.NewDecoderBytes(in, gMsgpackHandle).Decode(v)
+}
+
+// ReportPathV2 v1上报路径对应的v2路径, /loggather/report -> /loggather/v2/report
+func ReportPathV2(v1 string) string {
+	return path.Join(path.Dir(v1), "v2", path.Base(v1))
+}
+
+// BatchPath 上报路径对应的批量上报路径, /loggather/report -> /loggather/batch
+func BatchPath(report string) string {
+	return path.Join(path.Dir(report), "batch")
+}
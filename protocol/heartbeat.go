@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"path"
+)
+
+// Heartbeat 客户端定时发给所有上报的服务端, 服务端据此维护客户端列表
+// http发往 /loggather/heartbeat(JSON), 长连接上用FRAME_HEARTBEAT(msgpack)
+type Heartbeat struct {
+	Agent      AgentInfo       `json:"agent"`
+	ConfigHash string          `json:"config_hash,omitempty"` // 客户端配置的摘要, 用来发现配置没有同步的客户端
+	StartTime  int64           `json:"start_time"`            // 客户端启动时间
+	Interval   int             `json:"interval"`              // 心跳间隔(秒)
+	Lag        int64           `json:"lag"`                   // 所有文件的积压之和
+	Files      []HeartbeatFile `json:"files,omitempty"`
+}
+
+// HeartbeatFile 一个正在采集的文件, 轮转出去还没读完的文件合并到同名的文件中
+type HeartbeatFile struct {
+	Input string `json:"input"`
+	Name  string `json:"name"`
+	Lag   int64  `json:"lag"` // 文件大小减去已确认的位置
+}
+
+// HeartbeatPath 上报路径对应的心跳路径, /loggather/report -> /loggather/heartbeat
+func HeartbeatPath(report string) string {
+	return path.Join(path.Dir(report), "heartbeat")
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+
+	"third/go-metrics"
+)
+
+// 客户端和服务端的查询接口都以这个前缀输出go-metrics中的统计
+const PROMETHEUS_PREFIX = "loggather_"
+
+var gPromNamePattern = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func PromName(name string) string {
+	return PROMETHEUS_PREFIX + gPromNamePattern.ReplaceAllString(name, "_")
+}
+
+// WritePrometheus 按名字排序以Prometheus文本格式输出, skip返回true的由调用方自己输出
+// 计时器的单位换算为秒
+func WritePrometheus(w io.Writer, r metrics.Registry, skip func(name string) bool) {
+	all := make(map[string]interface{})
+	r.Each(func(name string, i interface{}) {
+		all[name] = i
+	})
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if skip != nil && skip(name) {
+			continue
+		}
+		n := PromName(name)
+		switch m := all[name].(type) {
+		case metrics.Counter:
+			fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", n, n, m.Count())
+		case metrics.Gauge:
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", n, n, m.Value())
+		case metrics.GaugeFloat64:
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %g\n", n, n, m.Value())
+		case metrics.Meter:
+			s := m.Snapshot()
+			fmt.Fprintf(w, "# TYPE %s_total counter\n%s_total %d\n", n, n, s.Count())
+			fmt.Fprintf(w, "# TYPE %s_rate1m gauge\n%s_rate1m %g\n", n, n, s.Rate1())
+		case metrics.Histogram:
+			s := m.Snapshot()
+			writeSummary(w, n, s.Percentiles([]float64{0.5, 0.9, 0.99}), float64(s.Sum()), s.Count(), 1)
+		case metrics.Timer:
+			s := m.Snapshot()
+			writeSummary(w, n+"_seconds", s.Percentiles([]float64{0.5, 0.9, 0.99}), float64(s.Sum()), s.Count(), 1e9)
+		}
+	}
+}
+
+func writeSummary(w io.Writer, n string, ps []float64, sum float64, count int64, unit float64) {
+	fmt.Fprintf(w, "# TYPE %s summary\n", n)
+	for i, q := range []string{"0.5", "0.9", "0.99"} {
+		fmt.Fprintf(w, "%s{quantile=\"%s\"} %g\n", n, q, ps[i]/unit)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", n, sum/unit, n, count)
+}
@@ -1,9 +1,42 @@
 package protocol
 
+// AgentInfo 上报数据来自哪个客户端, AgentId首次启动时生成并保存在采集进度旁边
+type AgentInfo struct {
+	AgentId  string `json:"agent_id,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Ip       string `json:"ip,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
 type LogGatherReport struct {
-	FileName    string `json:"file_name"`
-	LogInfoGzip []byte `json:"log_info"`
+	Agent    AgentInfo `json:"agent"`
+	FileName string    `json:"file_name"`
+	FileId   string    `json:"file_id,omitempty"` // 源文件实例的标识, 截断或内容被替换后会变; 为空时服务端不做去重
+	Codec    string    `json:"codec,omitempty"`   // 为空时是gzip
+	Offset   int64     `json:"offset,omitempty"`  // 本次数据在源文件中的范围[Offset, End)
+	End      int64     `json:"end,omitempty"`
+	LogInfo  []byte    `json:"log_info"` // 按Codec压缩后的日志
+
+	ChecksumAlgo string `json:"checksum_algo,omitempty"` // 为空时不校验
+	Checksum     uint32 `json:"checksum,omitempty"`      // 解压后数据的校验和
+}
+
+// LogGatherBatch 多个文件的数据合并成一次上报, 服务端逐条独立处理
+// 客户端信息只在批次上带一份, 条目中为空时使用批次的
+type LogGatherBatch struct {
+	Agent   AgentInfo         `json:"agent"`
+	Entries []LogGatherReport `json:"entries"`
+}
+
+// LogGatherResult 单条上报的结果, Code沿用http状态码
+// 409表示数据和服务端已确认的位置对不上(重叠或有空洞), 客户端应从Committed处继续
+type LogGatherResult struct {
+	FileName  string `json:"file_name"`
+	Code      int    `json:"code"`
+	Msg       string `json:"msg,omitempty"`
+	Committed int64  `json:"committed,omitempty"` // 服务端已写入的源文件位置, 客户端只推进到这里
 }
 
 type LogGatherResp struct {
+	Results []LogGatherResult `json:"results,omitempty"` // 批量上报时和Entries一一对应, 单条上报时只有一条
 }
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// 长连接帧格式: [4字节长度][1字节类型][8字节id][payload], 长度不含自身, 大端
+// 一个连接上可以同时有多个文件的上报, 服务端按id逐帧确认
+const (
+	FRAME_REPORT    = 1 // payload: msgpack编码的LogGatherReport
+	FRAME_ACK       = 2 // payload: msgpack编码的StreamAck, id和对应的上报相同
+	FRAME_PING      = 3
+	FRAME_PONG      = 4
+	FRAME_GOAWAY    = 5 // 服务端准备退出, 客户端不要再在这个连接上发新的上报
+	FRAME_BATCH     = 6 // payload: msgpack编码的LogGatherBatch, 确认中带逐条结果
+	FRAME_HEARTBEAT = 7 // payload: msgpack编码的Heartbeat, 确认中只有Code
+
+	FRAME_HEADER_SIZE = 13
+	MAX_FRAME_SIZE    = MAX_REPORT_BODY
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+type Frame struct {
+	Type    byte
+	Id      uint64
+	Payload []byte
+}
+
+// StreamAck 逐帧确认, Code沿用http状态码: 200成功, 4xx拒绝(重发也不会成功), 5xx失败
+type StreamAck struct {
+	Code    int               `json:"code"`
+	Msg     string            `json:"msg,omitempty"`
+	Results []LogGatherResult `json:"results,omitempty"` // 批量上报的逐条结果, 单条上报时只有一条
+}
+
+func WriteFrame(w io.Writer, f *Frame) error {
+	if len(f.Payload) > MAX_FRAME_SIZE {
+		return ErrFrameTooLarge
+	}
+	var header [FRAME_HEADER_SIZE]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(FRAME_HEADER_SIZE-4+len(f.Payload)))
+	header[4] = f.Type
+	binary.BigEndian.PutUint64(header[5:], f.Id)
+	// 合并成一次写, 避免帧被拆成两个tcp包
+	buf := make([]byte, 0, FRAME_HEADER_SIZE+len(f.Payload))
+	buf = append(buf, header[:]...)
+	buf = append(buf, f.Payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [FRAME_HEADER_SIZE]byte
+	if _, err := io.ReadFull(r, header[:]); nil != err {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[0:]))
+	if size < FRAME_HEADER_SIZE-4 || size-(FRAME_HEADER_SIZE-4) > MAX_FRAME_SIZE {
+		return nil, ErrFrameTooLarge
+	}
+	f := &Frame{
+		Type:    header[4],
+		Id:      binary.BigEndian.Uint64(header[5:]),
+		Payload: make([]byte, size-(FRAME_HEADER_SIZE-4)),
+	}
+	if _, err := io.ReadFull(r, f.Payload); nil != err {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"third/gin"
+	"time"
+
+	"backend/common/clog"
+	"backend/common/httputil"
+	"github.com/zh4af/loggather/protocol"
+)
+
+func HeartbeatHandle(c *gin.Context) {
+	defer httputil.MyRecovery()
+	handle_start_time := time.Now()
+
+	var err error
+	var req protocol.Heartbeat
+	var http_code = http.StatusOK
+
+	if err = httputil.ParseHttpReqToArgs(c.Request, &req); nil != err {
+		clog.Logger.Error("parse http req err: %v", err)
+		http_code = http.StatusBadRequest
+		goto Info
+	}
+
+	if err = RecordHeartbeat(&req, c.ClientIP()); nil != err {
+		http_code = http.StatusBadRequest
+	}
+
+Info:
+	httputil.SendResponse(c, http_code, nil, err)
+	clog.Logger.Debug("[cmd:Heartbeat][AgentId:%s][Host:%s][Files:%d][Cost:%dus][Err:%v]",
+		req.Agent.AgentId, req.Agent.Hostname, len(req.Files), time.Now().Sub(handle_start_time).Nanoseconds()/1000, err)
+}
+
+// 客户端列表, stale=true/false只返回超时/正常的客户端
+func AgentsHandle(c *gin.Context) {
+	defer httputil.MyRecovery()
+
+	agents := ListAgents()
+	if stale := c.Query("stale"); stale != "" {
+		want := stale == "true"
+		list := agents[:0]
+		for _, a := range agents {
+			if a.Stale == want {
+				list = append(list, a)
+			}
+		}
+		agents = list
+	}
+	httputil.SendResponse(c, http.StatusOK, agents, nil)
+}
+
+// 单个客户端, 带正在采集的文件和积压
+func AgentHandle(c *gin.Context) {
+	defer httputil.MyRecovery()
+
+	agent, err := GetAgent(c.Param("id"))
+	if nil != err {
+		httputil.SendResponse(c, http.StatusNotFound, nil, err)
+		return
+	}
+	httputil.SendResponse(c, http.StatusOK, agent, nil)
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"backend/common/clog"
+	"backend/common/config"
+	"github.com/zh4af/loggather/protocol"
+	"third/go-metrics"
+)
+
+const (
+	DEFAULT_AGENT_STALE_TIMEOUT = 90    // 秒, 客户端默认30秒一次心跳, 连续3次没有收到
+	DEFAULT_AGENT_EVICT_TIMEOUT = 86400 // 秒, 超时这么久后从列表中去掉, 下线或重装换了agent_id的客户端不会一直留着
+	AGENT_CHECK_INTERVAL        = time.Second * 10
+)
+
+var ErrAgentNotFound = errors.New("agent not found")
+
+// AgentState 一个客户端的最新状态, 只保存在内存中, 服务端重启后由下次心跳重新登记
+type AgentState struct {
+	protocol.Heartbeat
+	Addr          string `json:"addr"`           // 最近一次心跳的来源地址
+	FirstSeen     int64  `json:"first_seen"`     // 本服务端第一次收到心跳或上报的时间
+	LastHeartbeat int64  `json:"last_heartbeat"` // 旧版本客户端不发心跳, 为0
+	LastReport    int64  `json:"last_report"`    // 最近一次上报数据的时间
+	FileCount     int    `json:"file_count"`
+	Stale         bool   `json:"stale"` // 超过AgentStaleTimeout没有心跳也没有上报
+}
+
+var gAgents = struct {
+	sync.Mutex
+	agents map[string]*AgentState // key: agent_id
+}{agents: make(map[string]*AgentState, 1)}
+
+var gAgentsGauge = metrics.GetOrRegisterGauge("server.agents", nil)
+var gStaleAgentsGauge = metrics.GetOrRegisterGauge("server.agents_stale", nil)
+
+func staleTimeout() int64 {
+	if v, err := strconv.Atoi(config.Config.External["AgentStaleTimeout"]); nil == err && v > 0 {
+		return int64(v)
+	}
+	return DEFAULT_AGENT_STALE_TIMEOUT
+}
+
+// 不小于AgentStaleTimeout, 客户端先显示为超时, 再被去掉
+func evictTimeout() int64 {
+	timeout := int64(DEFAULT_AGENT_EVICT_TIMEOUT)
+	if v, err := strconv.Atoi(config.Config.External["AgentEvictTimeout"]); nil == err && v > 0 {
+		timeout = int64(v)
+	}
+	if stale := staleTimeout(); timeout < stale {
+		timeout = stale
+	}
+	return timeout
+}
+
+// 调用方需持有gAgents的锁
+func lockedAgent(agent_id string, now int64) *AgentState {
+	a, ok := gAgents.agents[agent_id]
+	if !ok {
+		a = &AgentState{FirstSeen: now}
+		gAgents.agents[agent_id] = a
+	}
+	return a
+}
+
+// RecordHeartbeat 登记或更新客户端, addr为心跳的来源地址
+func RecordHeartbeat(hb *protocol.Heartbeat, addr string) error {
+	if hb.Agent.AgentId == "" {
+		return ErrInvalidAgent
+	}
+	now := time.Now().Unix()
+
+	gAgents.Lock()
+	defer gAgents.Unlock()
+	a := lockedAgent(hb.Agent.AgentId, now)
+	if a.Stale {
+		clog.Logger.Info("agent %s (%s %s) is back", hb.Agent.AgentId, hb.Agent.Hostname, hb.Agent.Ip)
+	}
+	a.Heartbeat = *hb
+	a.Addr = addr
+	a.LastHeartbeat = now
+	a.FileCount = len(hb.Files)
+	a.Stale = false
+	return nil
+}
+
+// 上报数据也说明客户端还活着, 旧版本客户端只能通过上报登记
+func touchAgent(agent *protocol.AgentInfo) {
+	if agent.AgentId == "" {
+		return
+	}
+	now := time.Now().Unix()
+
+	gAgents.Lock()
+	defer gAgents.Unlock()
+	a := lockedAgent(agent.AgentId, now)
+	if a.LastHeartbeat == 0 {
+		a.Agent = *agent
+	}
+	a.LastReport = now
+	a.Stale = false
+}
+
+func (a *AgentState) lastSeen() int64 {
+	if a.LastReport > a.LastHeartbeat {
+		return a.LastReport
+	}
+	return a.LastHeartbeat
+}
+
+// 查询时按当前时间判断是否超时, 不等定时检查
+func (a *AgentState) snapshot(now, timeout int64) AgentState {
+	item := *a
+	item.Stale = now-a.lastSeen() > timeout
+	return item
+}
+
+// ListAgents 按agent_id排序, 不带文件列表
+func ListAgents() []AgentState {
+	now, timeout := time.Now().Unix(), staleTimeout()
+	gAgents.Lock()
+	defer gAgents.Unlock()
+	list := make([]AgentState, 0, len(gAgents.agents))
+	for _, a := range gAgents.agents {
+		item := a.snapshot(now, timeout)
+		item.Files = nil
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Agent.AgentId < list[j].Agent.AgentId })
+	return list
+}
+
+func GetAgent(agent_id string) (AgentState, error) {
+	now, timeout := time.Now().Unix(), staleTimeout()
+	gAgents.Lock()
+	defer gAgents.Unlock()
+	a, ok := gAgents.agents[agent_id]
+	if !ok {
+		return AgentState{}, ErrAgentNotFound
+	}
+	return a.snapshot(now, timeout), nil
+}
+
+// 定时检查, 客户端刚超时的时候打一条日志
+func watchAgents() {
+	tick := time.NewTicker(AGENT_CHECK_INTERVAL)
+	defer tick.Stop()
+	for range tick.C {
+		checkAgents(time.Now().Unix())
+	}
+}
+
+// 超过AgentEvictTimeout的客户端去掉, 再有心跳或上报时重新登记
+func checkAgents(now int64) {
+	timeout, evict := staleTimeout(), evictTimeout()
+
+	var stale int64
+	gAgents.Lock()
+	defer gAgents.Unlock()
+	for id, a := range gAgents.agents {
+		idle := now - a.lastSeen()
+		if idle > evict {
+			clog.Logger.Info("agent %s (%s %s) evicted, last seen %ds ago", id, a.Agent.Hostname, a.Agent.Ip, idle)
+			delete(gAgents.agents, id)
+			continue
+		}
+		if idle > timeout {
+			if !a.Stale {
+				clog.Logger.Warning("agent %s (%s %s) stale, last seen %ds ago", id, a.Agent.Hostname, a.Agent.Ip, idle)
+				a.Stale = true
+			}
+			stale++
+		}
+	}
+	gAgentsGauge.Update(int64(len(gAgents.agents)))
+	gStaleAgentsGauge.Update(stale)
+}
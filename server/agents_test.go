@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"backend/common/config"
+	"github.com/zh4af/loggather/protocol"
+)
+
+func TestCheckAgents(t *testing.T) {
+	config.Config = &config.Configure{External: map[string]string{"AgentStaleTimeout": "90", "AgentEvictTimeout": "3600"}}
+	gAgents.Lock()
+	gAgents.agents = make(map[string]*AgentState, 1)
+	gAgents.Unlock()
+
+	now := time.Now().Unix()
+	for _, id := range []string{"alive", "stale", "gone"} {
+		if err := RecordHeartbeat(&protocol.Heartbeat{Agent: protocol.AgentInfo{AgentId: id}}, "127.0.0.1"); nil != err {
+			t.Fatal(err)
+		}
+	}
+	gAgents.Lock()
+	gAgents.agents["stale"].LastHeartbeat = now - 100
+	gAgents.agents["gone"].LastHeartbeat = now - 3700
+	gAgents.Unlock()
+
+	checkAgents(now)
+	if _, err := GetAgent("gone"); err != ErrAgentNotFound {
+		t.Errorf("evicted agent: err %v, want %v", err, ErrAgentNotFound)
+	}
+	if a, err := GetAgent("stale"); nil != err || !a.Stale {
+		t.Errorf("stale agent: %+v, %v", a, err)
+	}
+	if a, err := GetAgent("alive"); nil != err || a.Stale {
+		t.Errorf("alive agent: %+v, %v", a, err)
+	}
+}
+
+func TestEvictTimeout(t *testing.T) {
+	cases := []struct {
+		stale, evict string
+		want         int64
+	}{
+		{"", "", DEFAULT_AGENT_EVICT_TIMEOUT},
+		{"90", "600", 600},
+		{"900", "600", 900},
+		{"90", "bad", DEFAULT_AGENT_EVICT_TIMEOUT},
+	}
+	for _, c := range cases {
+		config.Config = &config.Configure{External: map[string]string{"AgentStaleTimeout": c.stale, "AgentEvictTimeout": c.evict}}
+		if got := evictTimeout(); got != c.want {
+			t.Errorf("evictTimeout(stale %q, evict %q) = %d, want %d", c.stale, c.evict, got, c.want)
+		}
+	}
+}
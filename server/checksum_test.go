@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"third/gin"
+
+	"github.com/zh4af/loggather/protocol"
+)
+
+// 校验和对不上时返回422, 数据不写入, 进度不前进, 客户端重发后正常写入
+func TestReportLogChecksum(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+
+	crc, _ := protocol.Checksum(protocol.CHECKSUM_CRC32C, []byte("aaaaa"))
+	xx, _ := protocol.Checksum(protocol.CHECKSUM_XXHASH32, []byte("bbbbb"))
+	cases := []struct {
+		name          string
+		offset        int64
+		data          string
+		algo          string
+		sum           uint32
+		wantErr       error
+		wantCode      int
+		wantCommitted int64
+	}{
+		{"mismatch", 0, "aaaaa", protocol.CHECKSUM_CRC32C, crc + 1, protocol.ErrChecksumMismatch, protocol.CODE_CHECKSUM_MISMATCH, 0},
+		{"crc32c", 0, "aaaaa", protocol.CHECKSUM_CRC32C, crc, nil, http.StatusOK, 5},
+		{"xxhash32 mismatch", 5, "bbbbb", protocol.CHECKSUM_XXHASH32, xx ^ 0xff, protocol.ErrChecksumMismatch, protocol.CODE_CHECKSUM_MISMATCH, 5},
+		{"xxhash32", 5, "bbbbb", protocol.CHECKSUM_XXHASH32, xx, nil, http.StatusOK, 10},
+		{"unknown algo", 10, "ccccc", "md5", 0, protocol.ErrUnknownChecksum, http.StatusBadRequest, 10},
+		{"none", 10, "ccccc", protocol.CHECKSUM_NONE, 0, nil, http.StatusOK, 15},
+		{"without checksum", 15, "ddddd", "", 0, nil, http.StatusOK, 20},
+	}
+	for _, c := range cases {
+		req := testReport(t, "f1", c.offset, c.data)
+		req.ChecksumAlgo, req.Checksum = c.algo, c.sum
+		var reply protocol.LogGatherResp
+		err := ReportLog(req, &reply)
+		if err != c.wantErr {
+			t.Errorf("%s: err %v, want %v", c.name, err, c.wantErr)
+		}
+		if code := reportHttpCode(err); code != c.wantCode {
+			t.Errorf("%s: http code %d, want %d", c.name, code, c.wantCode)
+		}
+		if len(reply.Results) != 1 || reply.Results[0].Code != c.wantCode {
+			t.Errorf("%s: results %+v, want code %d", c.name, reply.Results, c.wantCode)
+		}
+		if c.wantErr == nil && reply.Results[0].Committed != c.wantCommitted {
+			t.Errorf("%s: committed %d, want %d", c.name, reply.Results[0].Committed, c.wantCommitted)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "app.log"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if string(buf) != "aaaaabbbbbcccccddddd" {
+		t.Errorf("stored %q, want %q", buf, "aaaaabbbbbcccccddddd")
+	}
+}
+
+// 批量上报中校验失败的条目单独返回422
+func TestReportBatchChecksum(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+
+	good := testReport(t, "f1", 0, "aaaaa")
+	good.ChecksumAlgo = protocol.CHECKSUM_CRC32C
+	good.Checksum, _ = protocol.Checksum(protocol.CHECKSUM_CRC32C, []byte("aaaaa"))
+	bad := testReport(t, "f2", 0, "bbbbb")
+	bad.ChecksumAlgo = protocol.CHECKSUM_CRC32C
+	bad.Checksum = good.Checksum
+
+	req := &protocol.LogGatherBatch{Agent: good.Agent, Entries: []protocol.LogGatherReport{*good, *bad}}
+	var reply protocol.LogGatherResp
+	if err := ReportBatch(req, &reply); nil != err {
+		t.Fatalf("ReportBatch err: %v", err)
+	}
+	if len(reply.Results) != 2 {
+		t.Fatalf("results = %d, want 2", len(reply.Results))
+	}
+	if r := reply.Results[0]; r.Code != http.StatusOK || r.Committed != 5 {
+		t.Errorf("good entry: code %d committed %d, want 200 5", r.Code, r.Committed)
+	}
+	if r := reply.Results[1]; r.Code != protocol.CODE_CHECKSUM_MISMATCH {
+		t.Errorf("bad entry: code %d, want %d", r.Code, protocol.CODE_CHECKSUM_MISMATCH)
+	}
+}
+
+// 校验失败的次数在服务端的统计接口中可以查到
+func TestChecksumMismatchMetrics(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+
+	before := gChecksumMismatchCount.Count()
+	req := testReport(t, "f1", 0, "aaaaa")
+	req.ChecksumAlgo, req.Checksum = protocol.CHECKSUM_CRC32C, 1
+	var reply protocol.LogGatherResp
+	if err := ReportLog(req, &reply); err != protocol.ErrChecksumMismatch {
+		t.Fatalf("err %v, want %v", err, protocol.ErrChecksumMismatch)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/metrics", MetricsPrometheusHandle)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/metrics", nil)
+	router.ServeHTTP(w, r)
+	want := fmt.Sprintf("loggather_server_checksum_mismatch %d\n", before+1)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("metrics: %d %q, want %q", w.Code, w.Body.String(), want)
+	}
+}
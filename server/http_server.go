@@ -15,7 +15,16 @@ func StartHttpServer(listen string) {
 	user_router := router.Group("/loggather")
 	{
 		user_router.POST("/report", ReportLogHandle)
+		user_router.POST("/v2/report", ReportLogV2Handle)
+		user_router.POST("/batch", ReportBatchHandle)
+		user_router.POST("/v2/batch", ReportBatchV2Handle)
+		user_router.POST("/heartbeat", HeartbeatHandle)
+		user_router.GET("/agents", AgentsHandle)
+		user_router.GET("/agents/:id", AgentHandle)
 	}
+	router.GET("/metrics", MetricsPrometheusHandle)
+	router.GET("/metrics.json", MetricsJsonHandle)
+	go watchAgents()
 
 	router.Run(listen)
 }
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"backend/common/clog"
+	"backend/common/config"
+)
+
+const (
+	DEFAULT_LEDGER_DIR = ".ledger" // 相对LogGatherDir
+	LEDGER_SUFFIX      = ".ledger"
+	LEDGER_MAX_IDS     = 16  // 每个客户端每个文件最多保留多少个文件实例的进度, 轮转时新旧文件会交替上报
+	LEDGER_IDLE_EXPIRE = 600 // 秒, 存储文件多久没有上报后从内存中去掉进度, 再上报时从进度文件加载
+
+	LEDGER_WRITE     = 0 // 正好接在已确认位置后面, 写入
+	LEDGER_DUPLICATE = 1 // 已经写过, 丢弃
+	LEDGER_CONFLICT  = 2 // 和已确认位置重叠或中间有空洞
+)
+
+type ledgerEntry struct {
+	Committed int64 `json:"committed"`
+	Time      int64 `json:"time"`
+}
+
+// fileLedger 一个存储文件的写入进度, 按客户端和源文件实例记录已经写入的源文件位置
+// 先写数据再更新进度, 两者之间崩溃时最多重复写入一块
+type fileLedger struct {
+	sync.Mutex
+	path   string
+	loaded bool
+	users  int                                // 正在使用的请求数, 由gLedgers的锁保护
+	last   time.Time                          // 最近一次使用, 由gLedgers的锁保护
+	Agents map[string]map[string]*ledgerEntry `json:"agents"` // agent_id -> file_id -> 进度
+}
+
+var gLedgers = struct {
+	sync.Mutex
+	files map[string]*fileLedger // key: 存储的相对路径
+}{files: make(map[string]*fileLedger, 1)}
+
+// 进度文件默认放在LogGatherDir/.ledger下, 和存储文件的相对路径一致
+func ledgerDir() string {
+	if dir := config.Config.External["LogLedgerDir"]; dir != "" {
+		return dir
+	}
+	return filepath.Join(config.Config.External["LogGatherDir"], DEFAULT_LEDGER_DIR)
+}
+
+// 返回时已加锁, 调用方处理完后unlockLedger
+func lockLedger(name string) (*fileLedger, error) {
+	now := time.Now()
+	gLedgers.Lock()
+	l, ok := gLedgers.files[name]
+	if !ok {
+		path, err := storagePath(ledgerDir(), name+LEDGER_SUFFIX)
+		if nil != err {
+			gLedgers.Unlock()
+			return nil, err
+		}
+		// 按日期命名或轮转出的存储文件不断出现, 顺便清理很久没有上报的, 进度已经保存在文件中
+		for old_name, old := range gLedgers.files {
+			if old.users == 0 && now.Sub(old.last) > LEDGER_IDLE_EXPIRE*time.Second {
+				delete(gLedgers.files, old_name)
+			}
+		}
+		l = &fileLedger{path: path}
+		gLedgers.files[name] = l
+	}
+	l.users++
+	l.last = now
+	gLedgers.Unlock()
+
+	l.Lock()
+	if !l.loaded {
+		if err := l.load(); nil != err {
+			unlockLedger(l)
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func unlockLedger(l *fileLedger) {
+	l.Unlock()
+	gLedgers.Lock()
+	l.users--
+	gLedgers.Unlock()
+}
+
+func (l *fileLedger) load() error {
+	l.Agents = make(map[string]map[string]*ledgerEntry, 1)
+	buf, err := ioutil.ReadFile(l.path)
+	if nil != err {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	} else if err = json.Unmarshal(buf, l); nil != err {
+		// 进度文件损坏时当作第一次见到, 由客户端的位置重新开始
+		clog.Logger.Error("decode ledger: %s err: %v", l.path, err)
+		l.Agents = make(map[string]map[string]*ledgerEntry, 1)
+	}
+	l.loaded = true
+	return nil
+}
+
+func (l *fileLedger) save() error {
+	buf, err := json.Marshal(l)
+	if nil != err {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(l.path), 0755); nil != err {
+		return err
+	}
+	return writeFileAtomic(l.path, buf)
+}
+
+// 先写临时文件并fsync, 再rename覆盖, 崩溃时只会留下旧的或新的完整文件
+func writeFileAtomic(path string, buf []byte) error {
+	tmp := path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if nil != err {
+		return err
+	}
+	if _, err = fp.Write(buf); nil == err {
+		err = fp.Sync()
+	}
+	if close_err := fp.Close(); nil == err {
+		err = close_err
+	}
+	if nil != err {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, path); nil != err {
+		return err
+	}
+
+	// rename本身也要落盘, 部分平台不支持对目录fsync, 忽略错误
+	if dir, err := os.Open(filepath.Dir(path)); nil == err {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// check 判断[offset, end)是否应该写入, 返回已确认的位置
+// 第一次见到的文件实例以客户端的位置为准, 服务端升级或进度丢失后不会让客户端从头重发
+func (l *fileLedger) check(agent_id, file_id string, offset, end int64) (int64, int) {
+	e, ok := l.Agents[agent_id][file_id]
+	if !ok {
+		return offset, LEDGER_WRITE
+	}
+	switch {
+	case end <= e.Committed:
+		return e.Committed, LEDGER_DUPLICATE
+	case offset == e.Committed:
+		return e.Committed, LEDGER_WRITE
+	}
+	return e.Committed, LEDGER_CONFLICT
+}
+
+func (l *fileLedger) commit(agent_id, file_id string, end int64) {
+	ids := l.Agents[agent_id]
+	if ids == nil {
+		ids = make(map[string]*ledgerEntry, 1)
+		l.Agents[agent_id] = ids
+	}
+	ids[file_id] = &ledgerEntry{Committed: end, Time: time.Now().Unix()}
+
+	// 去掉最久没有上报的文件实例
+	for len(ids) > LEDGER_MAX_IDS {
+		var oldest string
+		for id, e := range ids {
+			if oldest == "" || e.Time < ids[oldest].Time {
+				oldest = id
+			}
+		}
+		delete(ids, oldest)
+	}
+}
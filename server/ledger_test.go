@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"backend/common/config"
+	"github.com/zh4af/loggather/protocol"
+)
+
+// 存储目录换成临时目录, 进度缓存清空
+func setupStorage(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "loggather")
+	if nil != err {
+		t.Fatal(err)
+	}
+	config.Config = &config.Configure{External: map[string]string{"LogGatherDir": dir, "LogGatherLayout": "{file}"}}
+	gLedgers.Lock()
+	gLedgers.files = make(map[string]*fileLedger, 1)
+	gLedgers.Unlock()
+	return dir
+}
+
+func testReport(t *testing.T, file_id string, offset int64, data string) *protocol.LogGatherReport {
+	codec, _ := protocol.NewCodec(protocol.CODEC_GZIP, 0)
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, []byte(data)); nil != err {
+		t.Fatal(err)
+	}
+	return &protocol.LogGatherReport{
+		Agent:    protocol.AgentInfo{AgentId: "agent1", Hostname: "host1"},
+		FileName: "app.log",
+		FileId:   file_id,
+		Codec:    codec.Name(),
+		Offset:   offset,
+		End:      offset + int64(len(data)),
+		LogInfo:  buf.Bytes(),
+	}
+}
+
+func TestLedgerCheck(t *testing.T) {
+	l := &fileLedger{Agents: map[string]map[string]*ledgerEntry{
+		"agent1": {"f1": {Committed: 100}},
+	}}
+	cases := []struct {
+		name          string
+		agent, file   string
+		offset, end   int64
+		wantCommitted int64
+		wantAction    int
+	}{
+		{"unknown file starts at client offset", "agent1", "f2", 500, 600, 500, LEDGER_WRITE},
+		{"unknown agent", "agent2", "f1", 0, 10, 0, LEDGER_WRITE},
+		{"next chunk", "agent1", "f1", 100, 200, 100, LEDGER_WRITE},
+		{"duplicate", "agent1", "f1", 0, 100, 100, LEDGER_DUPLICATE},
+		{"duplicate inside", "agent1", "f1", 20, 50, 100, LEDGER_DUPLICATE},
+		{"gap", "agent1", "f1", 150, 200, 100, LEDGER_CONFLICT},
+		{"overlap", "agent1", "f1", 50, 150, 100, LEDGER_CONFLICT},
+	}
+	for _, c := range cases {
+		committed, action := l.check(c.agent, c.file, c.offset, c.end)
+		if committed != c.wantCommitted || action != c.wantAction {
+			t.Errorf("%s: check(%d, %d) = %d, %d, want %d, %d",
+				c.name, c.offset, c.end, committed, action, c.wantCommitted, c.wantAction)
+		}
+	}
+}
+
+func TestLedgerCommitKeepsRecentIds(t *testing.T) {
+	l := &fileLedger{Agents: make(map[string]map[string]*ledgerEntry, 1)}
+	for i := 0; i < LEDGER_MAX_IDS+4; i++ {
+		l.commit("agent1", string(rune('a'+i)), int64(i))
+		l.Agents["agent1"][string(rune('a'+i))].Time = int64(i)
+	}
+	if n := len(l.Agents["agent1"]); n != LEDGER_MAX_IDS {
+		t.Fatalf("ids = %d, want %d", n, LEDGER_MAX_IDS)
+	}
+	if _, ok := l.Agents["agent1"]["a"]; ok {
+		t.Errorf("oldest id is kept")
+	}
+}
+
+// 按顺序上报, 重复的丢弃, 有空洞或重叠时返回409和已确认的位置, 存储文件只写一次
+func TestReportLogConflict(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name          string
+		offset        int64
+		data          string
+		wantCode      int
+		wantCommitted int64
+	}{
+		{"first", 0, "aaaaa", http.StatusOK, 5},
+		{"duplicate", 0, "aaaaa", http.StatusOK, 5},
+		{"gap", 10, "ccccc", http.StatusConflict, 5},
+		{"overlap", 3, "xxxxx", http.StatusConflict, 5},
+		{"next", 5, "bbbbb", http.StatusOK, 10},
+		{"duplicate tail", 5, "bbbbb", http.StatusOK, 10},
+	}
+	for _, c := range cases {
+		var reply protocol.LogGatherResp
+		if err := ReportLog(testReport(t, "f1", c.offset, c.data), &reply); nil != err {
+			t.Fatalf("%s: ReportLog err: %v", c.name, err)
+		}
+		if len(reply.Results) != 1 {
+			t.Fatalf("%s: results = %d, want 1", c.name, len(reply.Results))
+		}
+		r := reply.Results[0]
+		if r.Code != c.wantCode || r.Committed != c.wantCommitted {
+			t.Errorf("%s: code %d committed %d, want %d %d", c.name, r.Code, r.Committed, c.wantCode, c.wantCommitted)
+		}
+		if c.wantCode == http.StatusConflict && r.Msg == "" {
+			t.Errorf("%s: conflict without message", c.name)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "app.log"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if string(buf) != "aaaaabbbbb" {
+		t.Errorf("stored %q, want %q", buf, "aaaaabbbbb")
+	}
+
+	// 进度保存后重新加载仍然有效
+	gLedgers.Lock()
+	gLedgers.files = make(map[string]*fileLedger, 1)
+	gLedgers.Unlock()
+	var reply protocol.LogGatherResp
+	if err = ReportLog(testReport(t, "f1", 0, "aaaaa"), &reply); nil != err {
+		t.Fatal(err)
+	}
+	if r := reply.Results[0]; r.Code != http.StatusOK || r.Committed != 10 {
+		t.Errorf("after reload: code %d committed %d, want 200 10", r.Code, r.Committed)
+	}
+}
+
+// 批量上报中单条冲突不影响其他条目
+func TestReportBatchConflict(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+
+	entries := []*protocol.LogGatherReport{
+		testReport(t, "f1", 0, "aaaaa"),
+		testReport(t, "f1", 10, "ccccc"),
+		testReport(t, "f1", 5, "bbbbb"),
+	}
+	req := &protocol.LogGatherBatch{Agent: entries[0].Agent}
+	for _, e := range entries {
+		e.Agent = protocol.AgentInfo{}
+		req.Entries = append(req.Entries, *e)
+	}
+	var reply protocol.LogGatherResp
+	if err := ReportBatch(req, &reply); nil != err {
+		t.Fatalf("ReportBatch err: %v", err)
+	}
+	want := []struct {
+		code      int
+		committed int64
+	}{{http.StatusOK, 5}, {http.StatusConflict, 5}, {http.StatusOK, 10}}
+	if len(reply.Results) != len(want) {
+		t.Fatalf("results = %d, want %d", len(reply.Results), len(want))
+	}
+	for i, w := range want {
+		if r := reply.Results[i]; r.Code != w.code || r.Committed != w.committed {
+			t.Errorf("entry %d: code %d committed %d, want %d %d", i, r.Code, r.Committed, w.code, w.committed)
+		}
+	}
+}
+
+// 没有文件实例标识时不去重, 也返回写到的位置
+func TestReportLogWithoutFileId(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+
+	var reply protocol.LogGatherResp
+	if err := ReportLog(testReport(t, "", 100, "aaaaa"), &reply); nil != err {
+		t.Fatal(err)
+	}
+	if r := reply.Results[0]; r.Code != http.StatusOK || r.Committed != 105 {
+		t.Errorf("code %d committed %d, want 200 105", r.Code, r.Committed)
+	}
+}
+
+// 很久没有上报的存储文件从内存中去掉, 再上报时从进度文件加载
+func TestLedgerEviction(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+
+	var reply protocol.LogGatherResp
+	if err := ReportLog(testReport(t, "f1", 0, "aaaaa"), &reply); nil != err {
+		t.Fatal(err)
+	}
+	gLedgers.Lock()
+	gLedgers.files["app.log"].last = time.Now().Add(-2 * LEDGER_IDLE_EXPIRE * time.Second)
+	gLedgers.Unlock()
+
+	other := testReport(t, "f1", 0, "bbbbb")
+	other.FileName = "other.log"
+	if err := ReportLog(other, &reply); nil != err {
+		t.Fatal(err)
+	}
+	gLedgers.Lock()
+	_, kept := gLedgers.files["app.log"]
+	n := len(gLedgers.files)
+	gLedgers.Unlock()
+	if kept || n != 1 {
+		t.Errorf("idle ledger kept: %v, ledgers %d, want 1", kept, n)
+	}
+
+	if err := ReportLog(testReport(t, "f1", 0, "aaaaa"), &reply); nil != err {
+		t.Fatal(err)
+	}
+	if r := reply.Results[0]; r.Code != http.StatusOK || r.Committed != 5 {
+		t.Errorf("after eviction: code %d committed %d, want 200 5", r.Code, r.Committed)
+	}
+	// 重复的数据按加载的进度丢弃
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "app.log")); string(buf) != "aaaaa" {
+		t.Errorf("stored %q, want %q", buf, "aaaaa")
+	}
+	if _, err := os.Stat(filepath.Join(ledgerDir(), "app.log"+LEDGER_SUFFIX+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("ledger tmp file left: %v", err)
+	}
+}
@@ -1,65 +1,277 @@
 package server
 
 import (
-	"bytes"
-	"compress/gzip"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"backend/common/clog"
 	"backend/common/config"
-	"backend/common/errcode"
 	// "backend/common/utils"
 	"github.com/zh4af/loggather/protocol"
+	"third/go-metrics"
 )
 
 // var gBufPool = utils.NewBufferPool()
 
+const (
+	DEFAULT_STORAGE_LAYOUT = "{file}"  // 和旧版本一样直接按文件名存储, 按客户端分目录需配置{host}等
+	UNKNOWN_AGENT_FIELD    = "unknown" // 旧版本客户端不带客户端信息
+)
+
+var ErrInvalidFileName = errors.New("invalid file name")
+var ErrInvalidAgent = errors.New("invalid agent info")
+var ErrInvalidBatch = errors.New("empty or too many batch entries")
+var ErrInvalidOffset = errors.New("invalid offset range")
+var ErrUndecodable = errors.New("undecodable report data")
+
+const DEFAULT_MAX_DECODED = 64 << 20 // 字节, 单条上报解压后的上限
+
+var gChecksumMismatchCount = metrics.GetOrRegisterCounter("server.checksum_mismatch", nil)
+
+// 解压后的大小限制, 防止很小的压缩数据解压出大量内容占满内存
+func maxDecoded() int {
+	if v, err := strconv.Atoi(config.Config.External["LogGatherMaxDecoded"]); nil == err && v > 0 {
+		return v
+	}
+	return DEFAULT_MAX_DECODED
+}
+
+// 客户端上报的是相对输入根目录的路径, 如 a/app.log
+// 不允许绝对路径和.., 清理后必须仍在存储根目录下面
+func checkFileName(file_name string) error {
+	if file_name == "" || strings.IndexByte(file_name, 0) >= 0 || strings.Contains(file_name, "\\") {
+		return ErrInvalidFileName
+	}
+	if path.IsAbs(file_name) {
+		return ErrInvalidFileName
+	}
+	for _, seg := range strings.Split(file_name, "/") {
+		if seg == ".." {
+			return ErrInvalidFileName
+		}
+	}
+	if rel := path.Clean(file_name); rel == "." || rel == "" {
+		return ErrInvalidFileName
+	}
+	return nil
+}
+
+func storagePath(root, file_name string) (string, error) {
+	if err := checkFileName(file_name); nil != err {
+		return "", err
+	}
+	return filepath.Join(root, filepath.FromSlash(path.Clean(file_name))), nil
+}
+
+// 客户端信息只能作为一级目录名
+func agentSegment(v string) (string, error) {
+	if v == "" {
+		return UNKNOWN_AGENT_FIELD, nil
+	}
+	if v == "." || v == ".." || strings.ContainsAny(v, "/\\\x00") {
+		return "", ErrInvalidAgent
+	}
+	return v, nil
+}
+
+// 按External.LogGatherLayout生成存储的相对路径, 支持{host} {ip} {agent} {file}, 默认{file}
+func layoutName(layout string, agent *protocol.AgentInfo, file_name string) (string, error) {
+	if err := checkFileName(file_name); nil != err {
+		return "", err
+	}
+	if layout == "" {
+		layout = DEFAULT_STORAGE_LAYOUT
+	}
+
+	pairs := []string{"{file}", path.Clean(file_name)}
+	for _, field := range [][2]string{{"{host}", agent.Hostname}, {"{ip}", agent.Ip}, {"{agent}", agent.AgentId}} {
+		if !strings.Contains(layout, field[0]) {
+			continue
+		}
+		seg, err := agentSegment(field[1])
+		if nil != err {
+			return "", err
+		}
+		pairs = append(pairs, field[0], seg)
+	}
+	return strings.NewReplacer(pairs...).Replace(layout), nil
+}
+
+// ReportLog 单条上报, 结果放在reply.Results[0]中
+// 和已写入的位置对不上时不返回错误, 结果的Code为409, 由客户端调整读取位置
 func ReportLog(req *protocol.LogGatherReport, reply *protocol.LogGatherResp) error {
-	var err error
-	var out []byte
+	result, err := reportEntry(req)
+	if nil != err {
+		result.Code = reportHttpCode(err)
+		result.Msg = err.Error()
+	}
+	reply.Results = []protocol.LogGatherResult{result}
+	return err
+}
 
-	if _, err = os.Stat(config.Config.External["LogGatherDir"]); nil != err {
-		os.Mkdir(config.Config.External["LogGatherDir"], 0644)
+// ReportBatch 逐条独立写入, 单条失败不影响其他条目, 结果按顺序放在reply.Results中
+func ReportBatch(req *protocol.LogGatherBatch, reply *protocol.LogGatherResp) error {
+	if len(req.Entries) == 0 || len(req.Entries) > protocol.MAX_BATCH_ENTRIES {
+		return ErrInvalidBatch
 	}
-	file_fp, err := os.OpenFile(config.Config.External["LogGatherDir"]+req.FileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-	defer file_fp.Close()
+
+	reply.Results = make([]protocol.LogGatherResult, len(req.Entries))
+	for i := range req.Entries {
+		if req.Entries[i].Agent == (protocol.AgentInfo{}) {
+			req.Entries[i].Agent = req.Agent
+		}
+		result, err := reportEntry(&req.Entries[i])
+		if nil != err {
+			result.Code = reportHttpCode(err)
+			result.Msg = err.Error()
+		}
+		reply.Results[i] = result
+	}
+	return nil
+}
+
+// 带FileId的上报按进度去重: 已写过的丢弃, 重叠或有空洞的拒绝, 都返回已确认的位置
+// 写入出错时Committed仍是实际写入后的位置
+func reportEntry(req *protocol.LogGatherReport) (protocol.LogGatherResult, error) {
+	result := protocol.LogGatherResult{FileName: req.FileName, Code: http.StatusOK}
+
+	name, err := layoutName(config.Config.External["LogGatherLayout"], &req.Agent, req.FileName)
 	if nil != err {
-		clog.Logger.Error("open log file err: %v", err)
-		return err
-	}
-
-	// var buf_src *bytes.Buffer = gBufPool.Get()
-	// var buf_dst *bytes.Buffer = gBufPool.Get()
-	// defer gBufPool.Put(buf_src)
-	// defer gBufPool.Put(buf_dst)
-	// if buf_src == nil || buf_dst == nil {
-	// 	err = errcode.NewInternalError(errcode.InternalErrorCode, err)
-	// 	clog.Logger.Error("get memory from buf pool err: %v", err)
-	// 	return err
-	// }
-	// if _, err = buf_src.Write(req.LogInfoGzip); nil != err {
-	// 	clog.Logger.Error("buf write data err: %v", err)
-	// 	return err
-	// }
-	buf_src := bytes.NewBuffer(req.LogInfoGzip)
-	gReader, err := gzip.NewReader(buf_src)
-	defer gReader.Close()
-	// _, err = gReader.Read(buf_dst.Bytes())
-	out, _ = ioutil.ReadAll(gReader)
+		clog.Logger.Error("report file name: %q agent: %+v err: %v", req.FileName, req.Agent, err)
+		return result, err
+	}
+	touchAgent(&req.Agent)
+	file_path, err := storagePath(config.Config.External["LogGatherDir"], name)
 	if nil != err {
-		err = errcode.NewInternalError(errcode.DecodeErrCode, err)
-		clog.Logger.Error("decode base64 str err: %v", err)
-		return err
+		clog.Logger.Error("report file name: %q err: %v", name, err)
+		return result, err
 	}
 
-	write_n, err := file_fp.Write(out)
+	var ledger *fileLedger
+	if req.FileId != "" {
+		if req.Offset < 0 || req.End < req.Offset {
+			return result, ErrInvalidOffset
+		}
+		if ledger, err = lockLedger(name); nil != err {
+			clog.Logger.Error("load ledger of %s err: %v", name, err)
+			return result, err
+		}
+		defer unlockLedger(ledger)
+
+		committed, action := ledger.check(req.Agent.AgentId, req.FileId, req.Offset, req.End)
+		result.Committed = committed
+		switch action {
+		case LEDGER_DUPLICATE:
+			clog.Logger.Info("report file: %s [%d, %d) already committed %d, drop it",
+				name, req.Offset, req.End, committed)
+			return result, nil
+		case LEDGER_CONFLICT:
+			result.Code = http.StatusConflict
+			if req.Offset > committed {
+				result.Msg = fmt.Sprintf("gap: offset %d after committed %d", req.Offset, committed)
+			} else {
+				result.Msg = fmt.Sprintf("overlap: offset %d before committed %d", req.Offset, committed)
+			}
+			clog.Logger.Warning("report file: %s file id: %s %s", name, req.FileId, result.Msg)
+			return result, nil
+		}
+	}
+
+	codec, err := protocol.NewCodec(req.Codec, 0)
+	if nil != err {
+		clog.Logger.Error("report file: %s codec: %s err: %v", req.FileName, req.Codec, err)
+		return result, err
+	}
+	out, err := codec.Decode(req.LogInfo, maxDecoded())
+	// 旧版本客户端的gzip数据没有Close, 缺少结尾, 读出的内容是完整的
+	if err == io.ErrUnexpectedEOF && req.Codec == "" {
+		err = nil
+	}
+	if err == protocol.ErrDecodedTooLarge {
+		clog.Logger.Error("report file: %s %s decoded data over %d bytes", req.FileName, codec.Name(), maxDecoded())
+		return result, err
+	}
 	if nil != err {
-		clog.Logger.Error("write log file err: %v", err)
-		return err
+		// 同样的数据重发也解不开, 按请求错误返回, 客户端不再重试
+		clog.Logger.Error("report file: %s %s decode data err: %v", req.FileName, codec.Name(), err)
+		return result, ErrUndecodable
+	}
+	if req.ChecksumAlgo != "" && req.ChecksumAlgo != protocol.CHECKSUM_NONE {
+		sum, err := protocol.Checksum(req.ChecksumAlgo, out)
+		if nil != err {
+			return result, err
+		}
+		if sum != req.Checksum {
+			gChecksumMismatchCount.Inc(1)
+			clog.Logger.Error("report file: %s [%d, %d) %s mismatch: %d != %d",
+				name, req.Offset, req.End, req.ChecksumAlgo, sum, req.Checksum)
+			return result, protocol.ErrChecksumMismatch
+		}
 	}
 
+	// 解压后的数据和源文件一一对应时, 只写入了一部分也可以确认到对应位置
+	keep_partial := ledger != nil && int64(len(out)) == req.End-req.Offset
+	write_n, err := appendFile(file_path, out, keep_partial)
+	if nil != err && write_n == 0 {
+		return result, err
+	}
 	clog.Logger.Debug("write to log file: %s bytes: %d", req.FileName, write_n)
 
-	return err
+	committed := req.End
+	if write_n < len(out) {
+		committed = req.Offset + int64(write_n)
+	}
+	// 没有文件实例标识时不去重, 也返回写到的位置, 客户端只按返回的位置推进
+	result.Committed = committed
+	if ledger != nil {
+		ledger.commit(req.Agent.AgentId, req.FileId, committed)
+		// 数据已经写入, 进度保存失败只会在重发时多写一次
+		if save_err := ledger.save(); nil != save_err {
+			clog.Logger.Error("save ledger of %s err: %v", name, save_err)
+		}
+	}
+	return result, err
+}
+
+// 返回写入的字节数, 出错时不保留部分写入的数据, 除非keep_partial
+// External.LogGatherFsync为true时落盘后才返回, 确认的位置在服务端崩溃后仍然有效
+func appendFile(file_path string, out []byte, keep_partial bool) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(file_path), 0755); nil != err {
+		clog.Logger.Error("make log dir err: %v", err)
+		return 0, err
+	}
+	file_fp, err := os.OpenFile(file_path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if nil != err {
+		clog.Logger.Error("open log file err: %v", err)
+		return 0, err
+	}
+	defer file_fp.Close()
+
+	size, err := file_fp.Seek(0, io.SeekEnd)
+	if nil != err {
+		clog.Logger.Error("seek log file err: %v", err)
+		return 0, err
+	}
+	write_n, err := file_fp.Write(out)
+	if nil == err && config.Config.External["LogGatherFsync"] == "true" {
+		err = file_fp.Sync()
+	}
+	if nil != err {
+		clog.Logger.Error("write log file: %s %d/%d bytes err: %v", file_path, write_n, len(out), err)
+		if write_n > 0 && !keep_partial {
+			if trunc_err := file_fp.Truncate(size); nil != trunc_err {
+				clog.Logger.Error("truncate log file: %s to %d err: %v", file_path, size, trunc_err)
+			}
+			write_n = 0
+		}
+		return write_n, err
+	}
+	return write_n, nil
 }
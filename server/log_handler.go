@@ -1,7 +1,15 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"third/gin"
 	"time"
 
@@ -11,6 +19,8 @@ import (
 	"github.com/zh4af/loggather/protocol"
 )
 
+var errReportTooLarge = errors.New("report body too large")
+
 func ReportLogHandle(c *gin.Context) {
 	defer httputil.MyRecovery()
 	handle_start_time := time.Now()
@@ -20,16 +30,219 @@ func ReportLogHandle(c *gin.Context) {
 	var reply protocol.LogGatherResp
 	var http_code = http.StatusOK
 
-	if err = httputil.ParseHttpParamsToArgs(c.Request, &req); nil != err {
+	if err = parseReportJson(c.Request, &req); nil != err {
 		clog.Logger.Error("parse http req err: %v", err)
-		http_code = http.StatusBadRequest
+		http_code = parseHttpCode(err)
+		goto Info
+	}
+
+	err = ReportLog(&req, &reply)
+	http_code = reportHttpCode(err)
+
+Info:
+	httputil.SendResponse(c, http_code, reply, err)
+	clog.Logger.Info("[cmd:ReportLog][Host:%s][FileName:%s][Cost:%dus][Err:%v]",
+		req.Agent.Hostname, req.FileName, time.Now().Sub(handle_start_time).Nanoseconds()/1000, err)
+}
+
+// v2上报: 请求体是压缩数据(文件名和压缩方式在header中), 或者msgpack编码的整个上报
+func ReportLogV2Handle(c *gin.Context) {
+	defer httputil.MyRecovery()
+	handle_start_time := time.Now()
+
+	var err error
+	var req protocol.LogGatherReport
+	var reply protocol.LogGatherResp
+	var http_code = http.StatusOK
+
+	if err = parseReportV2(c.Request, &req); nil != err {
+		clog.Logger.Error("parse v2 report err: %v", err)
+		http_code = parseHttpCode(err)
 		goto Info
 	}
 
 	err = ReportLog(&req, &reply)
+	http_code = reportHttpCode(err)
+
+Info:
+	httputil.SendResponse(c, http_code, reply, err)
+	clog.Logger.Info("[cmd:ReportLogV2][Host:%s][FileName:%s][Codec:%s][Cost:%dus][Err:%v]",
+		req.Agent.Hostname, req.FileName, req.Codec, time.Now().Sub(handle_start_time).Nanoseconds()/1000, err)
+}
+
+func parseReportV2(r *http.Request, req *protocol.LogGatherReport) error {
+	content_type, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if nil != err {
+		return err
+	}
+
+	body, err := readReportBody(r)
+	if nil != err {
+		return err
+	}
+
+	switch content_type {
+	case protocol.CONTENT_TYPE_BINARY:
+		if req.FileName, err = url.PathUnescape(r.Header.Get(protocol.HEADER_FILE_NAME)); nil != err {
+			return err
+		}
+		req.Codec = r.Header.Get(protocol.HEADER_CODEC)
+		if req.Agent.Hostname, err = url.PathUnescape(r.Header.Get(protocol.HEADER_HOSTNAME)); nil != err {
+			return err
+		}
+		req.Agent.AgentId = r.Header.Get(protocol.HEADER_AGENT_ID)
+		req.Agent.Ip = r.Header.Get(protocol.HEADER_IP)
+		req.Agent.Version = r.Header.Get(protocol.HEADER_VERSION)
+		req.FileId = r.Header.Get(protocol.HEADER_FILE_ID)
+		if req.Offset, err = headerInt(r, protocol.HEADER_OFFSET); nil != err {
+			return err
+		}
+		if req.End, err = headerInt(r, protocol.HEADER_END); nil != err {
+			return err
+		}
+		if req.ChecksumAlgo, req.Checksum, err = headerChecksum(r); nil != err {
+			return err
+		}
+		req.LogInfo = body
+		return nil
+	case protocol.CONTENT_TYPE_MSGPACK:
+		return protocol.DecodeMsgpack(body, req)
+	}
+	return protocol.ErrUnknownEncoding
+}
+
+// 批量上报, v1为json, v2为msgpack; 请求本身的错误返回4xx, 单条的错误在Results中
+func ReportBatchHandle(c *gin.Context) {
+	defer httputil.MyRecovery()
+	handle_start_time := time.Now()
+
+	var err error
+	var req protocol.LogGatherBatch
+	var reply protocol.LogGatherResp
+	var http_code = http.StatusOK
+
+	if err = parseReportJson(c.Request, &req); nil != err {
+		clog.Logger.Error("parse http req err: %v", err)
+		http_code = parseHttpCode(err)
+		goto Info
+	}
+
+	if err = ReportBatch(&req, &reply); nil != err {
+		http_code = http.StatusBadRequest
+	}
 
 Info:
 	httputil.SendResponse(c, http_code, reply, err)
-	clog.Logger.Info("[cmd:ReportLog][FileName:%s][Cost:%dus][Err:%v]",
-		req.FileName, time.Now().Sub(handle_start_time).Nanoseconds()/1000, err)
+	clog.Logger.Info("[cmd:ReportBatch][Entries:%d][Cost:%dus][Err:%v]",
+		len(req.Entries), time.Now().Sub(handle_start_time).Nanoseconds()/1000, err)
+}
+
+func ReportBatchV2Handle(c *gin.Context) {
+	defer httputil.MyRecovery()
+	handle_start_time := time.Now()
+
+	var err error
+	var req protocol.LogGatherBatch
+	var reply protocol.LogGatherResp
+	var http_code = http.StatusOK
+
+	if err = parseBatchV2(c.Request, &req); nil != err {
+		clog.Logger.Error("parse v2 batch err: %v", err)
+		http_code = parseHttpCode(err)
+		goto Info
+	}
+
+	if err = ReportBatch(&req, &reply); nil != err {
+		http_code = http.StatusBadRequest
+	}
+
+Info:
+	httputil.SendResponse(c, http_code, reply, err)
+	clog.Logger.Info("[cmd:ReportBatchV2][Entries:%d][Cost:%dus][Err:%v]",
+		len(req.Entries), time.Now().Sub(handle_start_time).Nanoseconds()/1000, err)
+}
+
+// 没有带的header为0
+func headerInt(r *http.Request, key string) (int64, error) {
+	v := r.Header.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// 没有带时不校验
+func headerChecksum(r *http.Request) (string, uint32, error) {
+	v := r.Header.Get(protocol.HEADER_CHECKSUM)
+	if v == "" {
+		return "", 0, nil
+	}
+	i := strings.IndexByte(v, ':')
+	if i < 0 {
+		return "", 0, protocol.ErrUnknownChecksum
+	}
+	sum, err := strconv.ParseUint(v[i+1:], 10, 32)
+	if nil != err {
+		return "", 0, err
+	}
+	return v[:i], uint32(sum), nil
+}
+
+func parseBatchV2(r *http.Request, req *protocol.LogGatherBatch) error {
+	content_type, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if nil != err {
+		return err
+	}
+	if content_type != protocol.CONTENT_TYPE_MSGPACK {
+		return protocol.ErrUnknownEncoding
+	}
+	body, err := readReportBody(r)
+	if nil != err {
+		return err
+	}
+	return protocol.DecodeMsgpack(body, req)
+}
+
+// 旧版本客户端不带Content-Type, 不论Content-Type都按json解析
+// ParseHttpParamsToArgs经过map转换会丢掉[]byte字段, ParseHttpReqToArgs只解析application/json
+func parseReportJson(r *http.Request, v interface{}) error {
+	body, err := readReportBody(r)
+	if nil != err {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func readReportBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, protocol.MAX_REPORT_BODY+1))
+	if nil != err {
+		return nil, err
+	}
+	if len(body) > protocol.MAX_REPORT_BODY {
+		return nil, errReportTooLarge
+	}
+	return body, nil
+}
+
+// 请求体解析失败时的状态码, 超出大小限制的客户端不能原样重发
+func parseHttpCode(err error) int {
+	if err == errReportTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func reportHttpCode(err error) int {
+	switch {
+	case nil == err:
+		return http.StatusOK
+	case err == ErrInvalidFileName || err == ErrInvalidAgent || err == ErrInvalidOffset || err == protocol.ErrUnknownCodec ||
+		err == protocol.ErrUnknownChecksum || err == ErrUndecodable:
+		return http.StatusBadRequest
+	case err == protocol.ErrChecksumMismatch:
+		return protocol.CODE_CHECKSUM_MISMATCH
+	case err == protocol.ErrDecodedTooLarge || err == errReportTooLarge:
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
 }
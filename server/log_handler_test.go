@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"third/gin"
+
+	"backend/common/config"
+	"github.com/zh4af/loggather/protocol"
+)
+
+// 旧版本客户端的json请求不带Content-Type, 也要按json解析
+func TestReportLogHandleContentType(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/loggather/report", ReportLogHandle)
+
+	cases := []struct {
+		name         string
+		content_type string
+		offset       int64
+		data         string
+	}{
+		{"no content type", "", 0, "aaaaa"},
+		{"json", "application/json", 5, "bbbbb"},
+		{"form content type", "application/x-www-form-urlencoded", 10, "ccccc"},
+	}
+	for _, c := range cases {
+		body, err := json.Marshal(testReport(t, "f1", c.offset, c.data))
+		if nil != err {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("POST", "/loggather/report", bytes.NewReader(body))
+		if c.content_type != "" {
+			req.Header.Set("Content-Type", c.content_type)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200: %s", c.name, w.Code, w.Body.String())
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "app.log"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if string(buf) != "aaaaabbbbbccccc" {
+		t.Errorf("stored %q, want %q", buf, "aaaaabbbbbccccc")
+	}
+}
+
+// 解压后超过上限的数据返回413, 不写入
+func TestReportLogDecodedTooLarge(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+	config.Config.External["LogGatherMaxDecoded"] = "8"
+
+	cases := []struct {
+		name     string
+		codec    string
+		data     string
+		wantCode int
+	}{
+		{"gzip within limit", protocol.CODEC_GZIP, "aaaaaaaa", http.StatusOK},
+		{"gzip over limit", protocol.CODEC_GZIP, "bbbbbbbbb", http.StatusRequestEntityTooLarge},
+		{"snappy over limit", protocol.CODEC_SNAPPY, "bbbbbbbbb", http.StatusRequestEntityTooLarge},
+		{"lz4 over limit", protocol.CODEC_LZ4, "bbbbbbbbb", http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		codec, _ := protocol.NewCodec(c.codec, 0)
+		var buf bytes.Buffer
+		if err := codec.Encode(&buf, []byte(c.data)); nil != err {
+			t.Fatal(err)
+		}
+		req := &protocol.LogGatherReport{Agent: protocol.AgentInfo{AgentId: "agent1"}, FileName: "app.log", Codec: c.codec, LogInfo: buf.Bytes()}
+		var reply protocol.LogGatherResp
+		err := ReportLog(req, &reply)
+		if code := reportHttpCode(err); code != c.wantCode {
+			t.Errorf("%s: http code %d, want %d, err: %v", c.name, code, c.wantCode, err)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "app.log"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if string(buf) != "aaaaaaaa" {
+		t.Errorf("stored %q, want %q", buf, "aaaaaaaa")
+	}
+}
+
+// 解不开的数据重发也不会成功, 返回400; 旧版本客户端没有结尾的gzip数据照常写入
+func TestReportLogUndecodable(t *testing.T) {
+	dir := setupStorage(t)
+	defer os.RemoveAll(dir)
+
+	truncated := testReport(t, "", 0, "aaaaa")
+	truncated.Codec = ""
+	truncated.LogInfo = truncated.LogInfo[:len(truncated.LogInfo)-8]
+	cases := []struct {
+		name     string
+		codec    string
+		data     []byte
+		wantCode int
+	}{
+		{"bad gzip", protocol.CODEC_GZIP, []byte("not gzip"), http.StatusBadRequest},
+		{"bad snappy", protocol.CODEC_SNAPPY, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, http.StatusBadRequest},
+		{"bad lz4", protocol.CODEC_LZ4, []byte("not lz4"), http.StatusBadRequest},
+		{"legacy gzip without trailer", "", truncated.LogInfo, http.StatusOK},
+	}
+	for _, c := range cases {
+		req := &protocol.LogGatherReport{Agent: protocol.AgentInfo{AgentId: "agent1"}, FileName: "app.log", Codec: c.codec, LogInfo: c.data}
+		var reply protocol.LogGatherResp
+		err := ReportLog(req, &reply)
+		if code := reportHttpCode(err); code != c.wantCode {
+			t.Errorf("%s: http code %d, want %d, err: %v", c.name, code, c.wantCode, err)
+		}
+	}
+}
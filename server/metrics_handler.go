@@ -0,0 +1,27 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"third/gin"
+
+	"github.com/zh4af/loggather/protocol"
+	"third/go-metrics"
+)
+
+// 服务端的统计都在go-metrics的默认registry中, 如 server.checksum_mismatch, server.agents
+func MetricsJsonHandle(c *gin.Context) {
+	buf, err := json.Marshal(metrics.DefaultRegistry)
+	if nil != err {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", buf)
+}
+
+func MetricsPrometheusHandle(c *gin.Context) {
+	var buf bytes.Buffer
+	protocol.WritePrometheus(&buf, metrics.DefaultRegistry, nil)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
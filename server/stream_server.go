@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"backend/common/clog"
+	"github.com/zh4af/loggather/protocol"
+)
+
+const (
+	STREAM_IDLE_TIMEOUT  = time.Second * 90 // 客户端每30秒ping一次, 超过3次没有任何帧就断开
+	STREAM_WRITE_TIMEOUT = time.Second * 10
+)
+
+// StreamServer 客户端长连接上报, 和http上报写入同样的文件
+type StreamServer struct {
+	ln       net.Listener
+	inflight sync.WaitGroup
+
+	sync.Mutex
+	conns    map[*streamConn]bool
+	draining bool
+}
+
+type streamConn struct {
+	conn  net.Conn
+	wlock sync.Mutex
+}
+
+var gStreamServer *StreamServer
+
+func StartStreamServer(listen string) error {
+	ln, err := net.Listen("tcp", listen)
+	if nil != err {
+		return err
+	}
+	gStreamServer = &StreamServer{ln: ln, conns: make(map[*streamConn]bool, 1)}
+	go gStreamServer.serve()
+	clog.Logger.Info("stream server listen on %s", listen)
+	return nil
+}
+
+// DrainStreamServer 不再接受新连接, 通知所有客户端换连接, 等正在处理的上报写完后关闭
+func DrainStreamServer(timeout time.Duration) {
+	if gStreamServer != nil {
+		gStreamServer.Drain(timeout)
+	}
+}
+
+func (s *StreamServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if nil != err {
+			s.Lock()
+			draining := s.draining
+			s.Unlock()
+			if draining {
+				return
+			}
+			clog.Logger.Error("stream accept err: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		c := &streamConn{conn: conn}
+		s.Lock()
+		if s.draining {
+			s.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[c] = true
+		s.Unlock()
+		go s.handleConn(c)
+	}
+}
+
+func (s *StreamServer) handleConn(c *streamConn) {
+	defer func() {
+		s.Lock()
+		delete(s.conns, c)
+		s.Unlock()
+		c.conn.Close()
+	}()
+
+	remote := c.conn.RemoteAddr().String()
+	r := bufio.NewReader(c.conn)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(STREAM_IDLE_TIMEOUT))
+		f, err := protocol.ReadFrame(r)
+		if nil != err {
+			clog.Logger.Debug("stream conn %s closed: %v", remote, err)
+			return
+		}
+
+		switch f.Type {
+		case protocol.FRAME_PING:
+			c.write(&protocol.Frame{Type: protocol.FRAME_PONG, Id: f.Id})
+		case protocol.FRAME_HEARTBEAT:
+			c.write(&protocol.Frame{Type: protocol.FRAME_ACK, Id: f.Id, Payload: handleStreamHeartbeat(f.Payload, remote)})
+		case protocol.FRAME_REPORT, protocol.FRAME_BATCH:
+			// 已经发出GOAWAY, 让客户端换一台服务端重发
+			s.Lock()
+			if s.draining {
+				s.Unlock()
+				b, _ := protocol.EncodeMsgpack(&protocol.StreamAck{Code: 503, Msg: "server draining"})
+				c.write(&protocol.Frame{Type: protocol.FRAME_ACK, Id: f.Id, Payload: b})
+				continue
+			}
+			s.inflight.Add(1)
+			s.Unlock()
+			// 同一个文件的上报客户端等确认后才发下一块, 不同文件可以并发处理
+			go func() {
+				defer s.inflight.Done()
+				var ack []byte
+				if f.Type == protocol.FRAME_BATCH {
+					ack = handleStreamBatch(f.Payload)
+				} else {
+					ack = handleStreamReport(f.Payload)
+				}
+				c.write(&protocol.Frame{Type: protocol.FRAME_ACK, Id: f.Id, Payload: ack})
+			}()
+		default:
+			clog.Logger.Warning("stream conn %s unknown frame type: %d", remote, f.Type)
+		}
+	}
+}
+
+func handleStreamReport(payload []byte) []byte {
+	handle_start_time := time.Now()
+
+	var req protocol.LogGatherReport
+	var reply protocol.LogGatherResp
+	var ack protocol.StreamAck
+
+	err := protocol.DecodeMsgpack(payload, &req)
+	if nil != err {
+		ack.Code = 400
+	} else {
+		err = ReportLog(&req, &reply)
+		ack.Code = reportHttpCode(err)
+	}
+	if nil != err {
+		ack.Msg = err.Error()
+	} else {
+		ack.Code, ack.Msg = reply.Results[0].Code, reply.Results[0].Msg
+	}
+	ack.Results = reply.Results
+	clog.Logger.Info("[cmd:StreamReportLog][FileName:%s][Codec:%s][Cost:%dus][Err:%v]",
+		req.FileName, req.Codec, time.Now().Sub(handle_start_time).Nanoseconds()/1000, err)
+
+	b, _ := protocol.EncodeMsgpack(&ack)
+	return b
+}
+
+func handleStreamBatch(payload []byte) []byte {
+	handle_start_time := time.Now()
+
+	var req protocol.LogGatherBatch
+	var reply protocol.LogGatherResp
+	var ack = protocol.StreamAck{Code: 200}
+
+	err := protocol.DecodeMsgpack(payload, &req)
+	if nil == err {
+		err = ReportBatch(&req, &reply)
+	}
+	if nil != err {
+		ack.Code = 400
+		ack.Msg = err.Error()
+	}
+	ack.Results = reply.Results
+	clog.Logger.Info("[cmd:StreamReportBatch][Entries:%d][Cost:%dus][Err:%v]",
+		len(req.Entries), time.Now().Sub(handle_start_time).Nanoseconds()/1000, err)
+
+	b, _ := protocol.EncodeMsgpack(&ack)
+	return b
+}
+
+func handleStreamHeartbeat(payload []byte, remote string) []byte {
+	var req protocol.Heartbeat
+	var ack = protocol.StreamAck{Code: 200}
+
+	err := protocol.DecodeMsgpack(payload, &req)
+	if nil == err {
+		if host, _, e := net.SplitHostPort(remote); nil == e {
+			remote = host
+		}
+		err = RecordHeartbeat(&req, remote)
+	}
+	if nil != err {
+		ack.Code = 400
+		ack.Msg = err.Error()
+	}
+	clog.Logger.Debug("[cmd:StreamHeartbeat][AgentId:%s][Host:%s][Files:%d][Err:%v]",
+		req.Agent.AgentId, req.Agent.Hostname, len(req.Files), err)
+
+	b, _ := protocol.EncodeMsgpack(&ack)
+	return b
+}
+
+func (c *streamConn) write(f *protocol.Frame) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+	if err := protocol.WriteFrame(c.conn, f); nil != err {
+		clog.Logger.Warning("stream conn %s write err: %v", c.conn.RemoteAddr(), err)
+		c.conn.Close()
+	}
+}
+
+func (s *StreamServer) Drain(timeout time.Duration) {
+	s.Lock()
+	s.draining = true
+	conns := make([]*streamConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.Unlock()
+
+	s.ln.Close()
+	for _, c := range conns {
+		c.write(&protocol.Frame{Type: protocol.FRAME_GOAWAY})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		clog.Logger.Info("stream server drained %d conns", len(conns))
+	case <-time.After(timeout):
+		clog.Logger.Warning("stream server drain timeout after %v", timeout)
+	}
+	for _, c := range conns {
+		c.conn.Close()
+	}
+}